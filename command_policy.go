@@ -0,0 +1,89 @@
+package kuberun
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/mattn/go-shellwords"
+)
+
+// originalCommandEnv is the variable containing the command requested by the client when a forced command runs.
+const originalCommandEnv = "SSH_ORIGINAL_COMMAND"
+
+// parseArgv splits a command line into arguments without involving a shell. Commands containing shell operators such
+// as ; | & < or > are rejected, since they cannot be executed as a single program.
+func parseArgv(command string) ([]string, error) {
+	parser := shellwords.NewParser()
+	args, err := parser.Parse(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse command (%w)", err)
+	}
+	if parser.Position >= 0 {
+		return nil, fmt.Errorf("the command contains shell operators")
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+// hasCommandFilter returns true if the exec requests are restricted by an allow or deny list.
+func (n *networkHandler) hasCommandFilter() bool {
+	return len(n.config.Commands.Allow) > 0 || len(n.config.Commands.Deny) > 0
+}
+
+// checkCommand parses the command requested by the client and checks the program against the allow and deny lists.
+// The program is matched by its full path and by its base name. The returned arguments are executed directly.
+func (n *networkHandler) checkCommand(command string) ([]string, error) {
+	args, err := parseArgv(command)
+	if err != nil {
+		return nil, err
+	}
+	program := args[0]
+	matches := func(patterns []string) bool {
+		return matchesPattern(patterns, program) || matchesPattern(patterns, path.Base(program))
+	}
+	if matches(n.config.Commands.Deny) {
+		return nil, fmt.Errorf("the program %s is denied by the server", program)
+	}
+	if len(n.config.Commands.Allow) > 0 && !matches(n.config.Commands.Allow) {
+		return nil, fmt.Errorf("the program %s is not allowed by the server", program)
+	}
+	return args, nil
+}
+
+// rejectRequest writes an audit log line for a rejected session request and returns the error for the client.
+func (c *channelHandler) rejectRequest(requestType string, err error) error {
+	c.networkHandler.logger.Noticef(
+		"rejected %s request of user %s on channel %d (%v)",
+		requestType,
+		c.networkHandler.username,
+		c.channelID,
+		err,
+	)
+	return err
+}
+
+// forcedProgram returns the forced command if one is configured, recording the original command in the environment
+// of the program. The second return value is false if no command is forced.
+func (c *channelHandler) forcedProgram(requestType string, originalCommand string) ([]string, bool, error) {
+	forceCommand := c.networkHandler.config.Commands.ForceCommand
+	if forceCommand == "" {
+		return nil, false, nil
+	}
+	c.networkHandler.logger.Infof(
+		"running forced command for %s request of user %s on channel %d",
+		requestType,
+		c.networkHandler.username,
+		c.channelID,
+	)
+	c.sshHandler.mutex.Lock()
+	if originalCommand != "" {
+		c.env[originalCommandEnv] = originalCommand
+	} else {
+		delete(c.env, originalCommandEnv)
+	}
+	c.sshHandler.mutex.Unlock()
+	program, err := c.parseProgram(forceCommand)
+	return program, true, err
+}
@@ -0,0 +1,83 @@
+package kuberun
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/containerssh/sshserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestChannelHandler(n *networkHandler) *channelHandler {
+	return &channelHandler{
+		networkHandler: n,
+		sshHandler:     &sshConnectionHandler{networkHandler: n, mutex: &sync.Mutex{}},
+		env:            map[string]string{},
+	}
+}
+
+func TestParseArgvShouldRejectShellOperators(t *testing.T) {
+	args, err := parseArgv(`git log --format='%an; %s' "a b"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git", "log", "--format=%an; %s", "a b"}, args)
+
+	for _, command := range []string{
+		"ls; rm -rf /",
+		"ls && rm -rf /",
+		"ls | sh",
+		"cat < /etc/shadow",
+		"echo foo > /etc/passwd",
+		"echo 'unterminated",
+		"",
+	} {
+		_, err := parseArgv(command)
+		assert.Error(t, err, command)
+	}
+}
+
+func TestCommandAllowListShouldMatchProgram(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Commands.Allow = []string{"git*", "/usr/bin/rsync"}
+	n.config.Commands.Deny = []string{"git-shell"}
+
+	args, err := n.checkCommand("git-upload-pack '/repo.git'")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git-upload-pack", "/repo.git"}, args)
+
+	_, err = n.checkCommand("/usr/bin/rsync --server .")
+	assert.NoError(t, err)
+	_, err = n.checkCommand("/usr/local/bin/git-shell")
+	assert.Error(t, err)
+	_, err = n.checkCommand("/bin/sh -c 'git status'")
+	assert.Error(t, err)
+	_, err = n.checkCommand("git status; sh")
+	assert.Error(t, err)
+}
+
+func TestDisabledRequestsShouldBeRejected(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Commands.DisableShell = true
+	n.config.Commands.DisableExec = true
+	n.config.Commands.DisabledSubsystems = []string{"sftp"}
+	c := newTestChannelHandler(n)
+	stdin := &bytes.Buffer{}
+	onExit := func(_ sshserver.ExitStatus) {}
+
+	assert.Error(t, c.OnShell(0, stdin, &bytes.Buffer{}, &bytes.Buffer{}, onExit))
+	assert.Error(t, c.OnExecRequest(0, "ls", stdin, &bytes.Buffer{}, &bytes.Buffer{}, onExit))
+	assert.Error(t, c.OnSubsystem(0, "sftp", stdin, &bytes.Buffer{}, &bytes.Buffer{}, onExit))
+	assert.Empty(t, n.channels)
+}
+
+func TestForcedCommandShouldExposeOriginalCommand(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Commands.ForceCommand = "/usr/local/bin/menu --restricted"
+	c := newTestChannelHandler(n)
+
+	program, ok, err := c.forcedProgram("exec", "rm -rf /")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/usr/local/bin/menu", "--restricted"}, program)
+	assert.Equal(t, "rm -rf /", c.programEnv()[originalCommandEnv])
+}
@@ -3,7 +3,9 @@ package kuberun
 import (
 	"time"
 
+	"github.com/containerssh/sshserver"
 	v1 "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // Config is the base configuration structure for kuberun
@@ -14,8 +16,63 @@ type Config struct {
 	Pod PodConfig `json:"pod" yaml:"pod" comment:"Container configuration"`
 	// Timeout specifies how long to wait for the Pod to come up.
 	Timeout time.Duration `json:"timeout" yaml:"timeout" comment:"Timeout for pod creation" default:"60s"`
+	// Profile is the name of this configuration profile. It is used to tell apart the warm pools of different
+	// configurations.
+	Profile string `json:"profile" yaml:"profile" comment:"Name of the configuration profile"`
+	// Pool configures a pool of pre-created pods that new connections can claim.
+	Pool PoolConfig `json:"pool" yaml:"pool" comment:"Warm pod pool configuration"`
+	// Workspace configures persistent per-user pods that are kept across connections.
+	Workspace WorkspaceConfig `json:"workspace" yaml:"workspace" comment:"Persistent workspace configuration"`
+	// Delete configures how the pod is removed when the connection closes.
+	Delete DeleteConfig `json:"delete" yaml:"delete" comment:"Pod deletion policy"`
+	// Retention configures when pods are kept after the connection closes for debugging.
+	Retention RetentionConfig `json:"retention" yaml:"retention" comment:"Retention policy for failed pods"`
+	// GC configures the heartbeats used by the garbage collector to find orphaned pods.
+	GC GCConfig `json:"gc" yaml:"gc" comment:"Orphaned pod garbage collection"`
+	// Owner configures an owner reference on the created pods, so Kubernetes removes them with their owner.
+	Owner OwnerConfig `json:"owner" yaml:"owner" comment:"Owner reference for created pods"`
+	// MaxConnectionDuration limits how long the pod of a connection may run. It is set as activeDeadlineSeconds on the
+	// pod, so workspace pods are limited from their creation. Zero means no limit.
+	MaxConnectionDuration time.Duration `json:"maxConnectionDuration" yaml:"maxConnectionDuration" comment:"Maximum time a pod may run. Zero means no limit."`
+	// MaxConnectionDurationWarning is how long before the maximum connection duration the user is warned in all
+	// running sessions.
+	MaxConnectionDurationWarning time.Duration `json:"maxConnectionDurationWarning" yaml:"maxConnectionDurationWarning" comment:"How long before the maximum connection duration to warn the user." default:"5m"`
+	// IdleTimeout closes the sessions of a connection if there was no stdin or stdout traffic on any session for this
+	// long. Zero means no limit.
+	IdleTimeout time.Duration `json:"idleTimeout" yaml:"idleTimeout" comment:"Close the connection after no session traffic for this long. Zero means no limit."`
+	// Env configures which environment variables clients may pass to programs.
+	Env EnvConfig `json:"env" yaml:"env" comment:"Environment variable policy for client requests"`
+	// Commands restricts which programs clients can run.
+	Commands CommandPolicyConfig `json:"commands" yaml:"commands" comment:"Forced command and program restrictions"`
+	// ExitStatus configures the exit statuses reported when a program could not be run or streamed.
+	ExitStatus ExitStatusConfig `json:"exitStatus" yaml:"exitStatus" comment:"Exit statuses for failures outside the program"`
+	// Events configures the Kubernetes events recorded against the pod for the connection lifecycle.
+	Events EventsConfig `json:"events" yaml:"events" comment:"Kubernetes events for the connection lifecycle"`
+	// UserMapping maps SSH users to Unix users in the pod.
+	UserMapping UserMappingConfig `json:"userMapping" yaml:"userMapping" comment:"Mapping of SSH users to Unix users in the pod"`
+	// WorkingDirectory configures the directory programs start in.
+	WorkingDirectory WorkingDirectoryConfig `json:"workingDirectory" yaml:"workingDirectory" comment:"Working directory of programs"`
+	// SessionStop configures how programs are stopped when their channel closes or the connection drops.
+	SessionStop SessionStopConfig `json:"sessionStop" yaml:"sessionStop" comment:"Stopping programs when the channel closes or the connection drops"`
+	// StartMode specifies when the pod is created. See StartMode for the possible values.
+	StartMode StartMode `json:"startMode" yaml:"startMode" comment:"When to create the pod: handshake, background or session" default:"handshake"`
 }
 
+// StartMode specifies at which point of the connection the pod is created.
+type StartMode string
+
+const (
+	// StartModeHandshake creates the pod during the handshake and waits for it to become ready before the handshake
+	// completes.
+	StartModeHandshake StartMode = "handshake"
+	// StartModeBackground starts creating the pod when the handshake completes, but does not wait for it. Session
+	// requests wait for the pod to become ready.
+	StartModeBackground StartMode = "background"
+	// StartModeSession creates the pod when the first session channel is opened. Connections that never open a
+	// session channel will not create a pod.
+	StartModeSession StartMode = "session"
+)
+
 // ConnectionConfig configures the connection to the Kubernetes cluster.
 type ConnectionConfig struct {
 	// Host is a host string, a host:port pair, or a URL to the Kubernetes apiserver. Defaults to kubernetes.default.svc.
@@ -61,6 +118,271 @@ type ConnectionConfig struct {
 	Timeout time.Duration `json:"timeout" yaml:"timeout" comment:"Timeout"`
 }
 
+// PoolConfig configures a pool of ready, unassigned pods. When a connection starts it claims a pod from the pool and
+// the pool is refilled in the background. If the pool is empty a pod is created as usual.
+//
+// The pool is maintained by the WarmPool created with NewWarmPool, which must be run when the server starts. Claimed
+// pods do not have the CONTAINERSSH_* variables in their container environment; they are passed to each program with
+// the env command instead, so the pool is not used if Pod.EnvCommand is empty. With the garbage collector enabled,
+// unassigned pods are removed once no replica maintains the pool.
+type PoolConfig struct {
+	// Size is the number of ready, unassigned pods to keep for the profile. 0 disables the pool.
+	Size int `json:"size" yaml:"size" comment:"Number of unassigned pods to keep ready. 0 disables the pool." default:"0"`
+	// MaxIdleAge is the time after which an unassigned pod is replaced by a new one. 0 keeps pods indefinitely.
+	MaxIdleAge time.Duration `json:"maxIdleAge" yaml:"maxIdleAge" comment:"Replace unassigned pods older than this." default:"1h"`
+	// RefillInterval is the interval at which the pool is checked if it is not triggered by a claim.
+	RefillInterval time.Duration `json:"refillInterval" yaml:"refillInterval" comment:"Interval to check the pool size." default:"10s"`
+}
+
+// WorkspaceConfig configures persistent workspaces. When enabled, each user gets a single pod with a deterministic name
+// that is shared by all connections of the user, on any ContainerSSH replica. The connections are recorded as
+// annotations on the pod, and the pod is removed once it has had no connections for IdleTTL.
+//
+// The time the last connection detached is recorded on the pod, so the garbage collector removes idle workspace pods
+// even if the replica that recorded it has stopped. Workspaces therefore require GC.Enable and a running
+// GarbageCollector.
+type WorkspaceConfig struct {
+	// Enable turns on persistent workspaces. The warm pool is not used for workspace pods.
+	Enable bool `json:"enable" yaml:"enable" comment:"Reuse a per-user pod across connections" default:"false"`
+	// IdleTTL is the time the workspace pod is kept after the last connection closed.
+	IdleTTL time.Duration `json:"idleTTL" yaml:"idleTTL" comment:"Remove the workspace pod after it has had no connections for this long." default:"30m"`
+}
+
+// DeleteConfig configures how pods are removed when the connection closes.
+type DeleteConfig struct {
+	// GracePeriodSeconds overrides the termination grace period of the pod. Negative values use the grace period
+	// from the pod spec.
+	GracePeriodSeconds int64 `json:"gracePeriodSeconds" yaml:"gracePeriodSeconds" comment:"Termination grace period in seconds. Negative values use the pod setting." default:"-1"`
+	// PropagationPolicy is the deletion propagation policy: Orphan, Background or Foreground. Empty uses the server
+	// default.
+	PropagationPolicy meta.DeletionPropagation `json:"propagationPolicy" yaml:"propagationPolicy" comment:"Deletion propagation policy: Orphan, Background or Foreground."`
+	// CheckUID only deletes the pod if its UID matches the created pod, so a replacement pod with the same name is never
+	// deleted.
+	CheckUID bool `json:"checkUID" yaml:"checkUID" comment:"Only delete the pod if it has the same UID as the created pod." default:"true"`
+	// Wait blocks the disconnect until the pod is gone. New pods for the same user also wait for previous pods of the
+	// user that are still being deleted, so their quota is freed first.
+	Wait bool `json:"wait" yaml:"wait" comment:"Wait until the pod is gone on disconnect and before creating a new pod for the same user." default:"false"`
+	// WaitTimeout is the maximum time to wait for the pod to be gone.
+	WaitTimeout time.Duration `json:"waitTimeout" yaml:"waitTimeout" comment:"Maximum time to wait for the pod to be gone." default:"60s"`
+}
+
+// RetentionConfig configures keeping pods after an abnormal end of the connection. Retained pods are labelled with
+// containerssh_retained and annotated with containerssh.io/retain-until and containerssh.io/retain-reason. They are
+// removed by the Reaper once the retention period is over.
+type RetentionConfig struct {
+	// Duration is the time a pod is retained for. 0 disables retention.
+	Duration time.Duration `json:"duration" yaml:"duration" comment:"Time to keep pods for debugging. 0 disables retention." default:"0"`
+	// OnPodFailure retains pods that are in the Failed phase.
+	OnPodFailure bool `json:"onPodFailure" yaml:"onPodFailure" comment:"Retain pods that failed." default:"true"`
+	// OnKilled retains the pod if the last session exited with status 137.
+	OnKilled bool `json:"onKilled" yaml:"onKilled" comment:"Retain the pod if the last session exited with status 137." default:"true"`
+	// OnNonZeroExit retains the pod if the last session exited with any non-zero status.
+	OnNonZeroExit bool `json:"onNonZeroExit" yaml:"onNonZeroExit" comment:"Retain the pod if the last session exited with a non-zero status." default:"false"`
+	// Label retains the pod if an administrator has set this label on it.
+	Label string `json:"label" yaml:"label" comment:"Retain the pod if this label is set on it." default:"containerssh.io/retain"`
+	// ReapInterval is the interval at which the Reaper checks for expired pods.
+	ReapInterval time.Duration `json:"reapInterval" yaml:"reapInterval" comment:"Interval to check for expired retained pods." default:"1m"`
+}
+
+// GCConfig configures the garbage collection of pods that were left behind when ContainerSSH stopped without
+// running OnDisconnect. When enabled, each pod records the owning instance in the containerssh.io/instance annotation
+// and a periodic heartbeat in the containerssh.io/heartbeat annotation. The GarbageCollector removes pods whose
+// heartbeat has stopped, or whose connection is no longer known to the owning instance.
+type GCConfig struct {
+	// Enable records the owning instance and heartbeats on each pod.
+	Enable bool `json:"enable" yaml:"enable" comment:"Record the owning instance and heartbeats on pods." default:"false"`
+	// InstanceID identifies this ContainerSSH instance. Defaults to the hostname.
+	InstanceID string `json:"instanceID" yaml:"instanceID" comment:"Identifier of this instance. Defaults to the hostname."`
+	// HeartbeatInterval is the interval at which connections update the heartbeat on their pod.
+	HeartbeatInterval time.Duration `json:"heartbeatInterval" yaml:"heartbeatInterval" comment:"Interval for updating the heartbeat on pods." default:"30s"`
+	// HeartbeatTimeout is the time after the last heartbeat after which a pod is considered orphaned.
+	HeartbeatTimeout time.Duration `json:"heartbeatTimeout" yaml:"heartbeatTimeout" comment:"Pods without a heartbeat for this long are removed." default:"5m"`
+	// Interval is the interval at which the leader looks for orphaned pods.
+	Interval time.Duration `json:"interval" yaml:"interval" comment:"Interval for collecting orphaned pods." default:"1m"`
+	// LeaseName is the name of the Lease used for electing the collecting replica.
+	LeaseName string `json:"leaseName" yaml:"leaseName" comment:"Name of the Lease for leader election." default:"containerssh-gc"`
+	// LeaseNamespace is the namespace of the Lease. Defaults to the pod namespace.
+	LeaseNamespace string `json:"leaseNamespace" yaml:"leaseNamespace" comment:"Namespace of the Lease. Defaults to the pod namespace."`
+	// LeaseDuration is the time non-leaders wait before trying to take over the Lease.
+	LeaseDuration time.Duration `json:"leaseDuration" yaml:"leaseDuration" comment:"Lease duration for leader election." default:"15s"`
+	// LeaseRenewDeadline is the time the leader retries renewing the Lease before giving up leadership.
+	LeaseRenewDeadline time.Duration `json:"leaseRenewDeadline" yaml:"leaseRenewDeadline" comment:"Renew deadline for leader election." default:"10s"`
+	// LeaseRetryPeriod is the time between attempts to acquire or renew the Lease.
+	LeaseRetryPeriod time.Duration `json:"leaseRetryPeriod" yaml:"leaseRetryPeriod" comment:"Retry period for leader election." default:"2s"`
+}
+
+// EnvConfig configures which environment variables requested by clients are passed to programs, similar to the
+// AcceptEnv option of OpenSSH. The TERM variable from the PTY request is always passed.
+type EnvConfig struct {
+	// Allow contains glob patterns of variable names that clients may set, e.g. LANG, LC_* or GIT_*. The default
+	// allows all variables except the ones that are always denied.
+	Allow []string `json:"allow" yaml:"allow" comment:"Glob patterns of variable names clients may set." default:"[\"*\"]"`
+	// Deny contains glob patterns of variable names that clients may not set. Deny takes precedence over Allow.
+	// Variables that change how programs are loaded or which programs run, LD_*, BASH_ENV, ENV and PATH, are always
+	// denied, since they would bypass the forced command, the command restrictions and the user mapping.
+	Deny []string `json:"deny" yaml:"deny" comment:"Glob patterns of variable names clients may not set." default:"[\"CONTAINERSSH_*\"]"`
+	// MaxValueLength is the maximum length of a single value in bytes. Zero means no limit.
+	MaxValueLength int `json:"maxValueLength" yaml:"maxValueLength" comment:"Maximum length of a variable value in bytes." default:"4096"`
+	// MaxSessionSize is the maximum total size of the names and values set by the client in a session in bytes. Zero
+	// means no limit.
+	MaxSessionSize int `json:"maxSessionSize" yaml:"maxSessionSize" comment:"Maximum total size of the client variables in a session in bytes." default:"65536"`
+	// Force contains variables set by the server. They override the values requested by the client.
+	Force map[string]string `json:"force" yaml:"force" comment:"Variables set by the server, overriding client values."`
+}
+
+// CommandPolicyConfig restricts the programs clients can run, similar to the ForceCommand option of OpenSSH.
+type CommandPolicyConfig struct {
+	// ForceCommand runs this command for every shell, exec and subsystem request instead of the requested program.
+	// The command requested by exec requests is passed in the SSH_ORIGINAL_COMMAND environment variable.
+	ForceCommand string `json:"forceCommand" yaml:"forceCommand" comment:"Run this command instead of the requested program."`
+	// Allow contains glob patterns of programs exec requests may run, matched against the full path and the base name.
+	// If set, commands are split into arguments without a shell and commands containing shell operators are rejected.
+	Allow []string `json:"allow" yaml:"allow" comment:"Glob patterns of programs exec requests may run."`
+	// Deny contains glob patterns of programs exec requests may not run. Deny takes precedence over Allow. If set,
+	// commands are split into arguments without a shell, like with Allow. Programs that run other programs, such as
+	// shells or env, can be used to bypass the deny list and should be denied as well.
+	Deny []string `json:"deny" yaml:"deny" comment:"Glob patterns of programs exec requests may not run."`
+	// DisableShell rejects shell requests. The exec allow and deny lists only apply to exec requests, so profiles
+	// restricted with them should disable shell requests and subsystems as well.
+	DisableShell bool `json:"disableShell" yaml:"disableShell" comment:"Reject shell requests." default:"false"`
+	// DisableExec rejects exec requests.
+	DisableExec bool `json:"disableExec" yaml:"disableExec" comment:"Reject exec requests." default:"false"`
+	// DisabledSubsystems contains the names of subsystems that are rejected.
+	DisabledSubsystems []string `json:"disabledSubsystems" yaml:"disabledSubsystems" comment:"Names of subsystems to reject."`
+}
+
+// ExitStatusConfig configures the exit statuses reported to the client for failures that are not caused by the
+// program itself. Programs killed by a signal are reported with 128 plus the signal number.
+type ExitStatusConfig struct {
+	// SetupFailure is reported if the program could not be started, e.g. because the pod failed to start or the
+	// container is not running.
+	SetupFailure sshserver.ExitStatus `json:"setupFailure" yaml:"setupFailure" comment:"Exit status if the program could not be started." default:"254"`
+	// StreamFailure is reported if the connection to the running program was interrupted, e.g. because the API server
+	// stream broke.
+	StreamFailure sshserver.ExitStatus `json:"streamFailure" yaml:"streamFailure" comment:"Exit status if the connection to the program was interrupted." default:"255"`
+}
+
+// EventsConfig configures the Kubernetes events recorded against the pod when a user connects, sessions start and
+// exit, and the user disconnects.
+type EventsConfig struct {
+	// Enable records events. Requires permission to create and patch events in the pod namespace, which existing
+	// deployments may not have, so it is disabled by default.
+	Enable bool `json:"enable" yaml:"enable" comment:"Record Kubernetes events for the connection lifecycle." default:"false"`
+	// QPS is the rate at which events are recorded per connection after the burst is used up.
+	QPS float32 `json:"qps" yaml:"qps" comment:"Rate of events per connection after the burst." default:"0.2"`
+	// Burst is the number of events a connection can record before the rate limit applies.
+	Burst int `json:"burst" yaml:"burst" comment:"Number of events per connection before rate limiting." default:"25"`
+}
+
+// UserMappingMode selects how the mapped Unix user is applied.
+type UserMappingMode string
+
+const (
+	// UserMappingModeNone disables the user mapping. Programs run as the container user.
+	UserMappingModeNone UserMappingMode = ""
+	// UserMappingModePod sets runAsUser, runAsGroup and fsGroup in the security context of the pod. The warm pool is
+	// not used for mapped users, since pooled pods already run as a fixed user.
+	UserMappingModePod UserMappingMode = "pod"
+	// UserMappingModeExec drops privileges for each program with the setpriv command. The container must run as root.
+	UserMappingModeExec UserMappingMode = "exec"
+)
+
+// MappedUser is the Unix user the programs of an SSH user run as.
+type MappedUser struct {
+	// Name is the Unix username, set as USER and LOGNAME. Empty uses the SSH username.
+	Name string `json:"name" yaml:"name" comment:"Unix username. Defaults to the SSH username."`
+	// UID is the numeric user ID.
+	UID int64 `json:"uid" yaml:"uid" comment:"Numeric user ID."`
+	// GID is the numeric primary group ID.
+	GID int64 `json:"gid" yaml:"gid" comment:"Numeric group ID."`
+	// Home is the home directory, created if missing. Empty leaves HOME unchanged.
+	Home string `json:"home" yaml:"home" comment:"Home directory of the user."`
+	// Shell is the shell run for shell requests. Empty uses the configured shell command.
+	Shell string `json:"shell" yaml:"shell" comment:"Shell of the user."`
+}
+
+// UserMappingConfig maps SSH usernames to Unix users. The user is looked up in the static table first, then in the
+// passwd file. In the exec mode the user may also be read from pod annotations, e.g. set by an admission webhook.
+type UserMappingConfig struct {
+	// Mode selects how the mapped user is applied. See UserMappingMode for the possible values.
+	Mode UserMappingMode `json:"mode" yaml:"mode" comment:"How to apply the mapped user: empty to disable, pod or exec" default:""`
+	// Users is the static table of mapped users by SSH username.
+	Users map[string]MappedUser `json:"users" yaml:"users" comment:"Static mapping of SSH usernames to Unix users."`
+	// PasswdFile is the path of a file in the passwd format on the ContainerSSH host.
+	PasswdFile string `json:"passwdFile" yaml:"passwdFile" comment:"File in the passwd format to look up users in."`
+	// AnnotationPrefix is the prefix of the pod annotations containing the name, uid, gid, home and shell of the user.
+	// Only used in the exec mode. Empty disables the annotations.
+	AnnotationPrefix string `json:"annotationPrefix" yaml:"annotationPrefix" comment:"Prefix of the pod annotations with the user details (exec mode)." default:"containerssh.io/user-"`
+	// Required rejects connections of users who are not mapped. Otherwise they run as the container user.
+	Required bool `json:"required" yaml:"required" comment:"Reject users who are not mapped." default:"false"`
+	// SetprivCommand is the command used to drop privileges in the exec mode.
+	SetprivCommand string `json:"setprivCommand" yaml:"setprivCommand" comment:"Command to drop privileges with (exec mode)." default:"setpriv"`
+	// CreateHome creates the home directory of the user when the pod is ready if it is missing.
+	CreateHome bool `json:"createHome" yaml:"createHome" comment:"Create the home directory if it is missing." default:"true"`
+}
+
+// WorkingDirectoryConfig configures the directory shell, exec and subsystem programs start in.
+type WorkingDirectoryConfig struct {
+	// Default is the directory programs start in. It is a Go template with the fields Username, ConnectionID, Profile
+	// and Home, the home directory of the mapped user, e.g. /home/{{.Username}}. Empty keeps the working directory of
+	// the container.
+	Default string `json:"default" yaml:"default" comment:"Default working directory template, e.g. /home/{{.Username}}. Empty uses the container default."`
+	// Env is the name of the environment variable clients can set to request a working directory, e.g. LC_WORKDIR,
+	// which OpenSSH clients send with SendEnv LC_*. The variable is not passed to the program. Empty disables
+	// client-requested directories.
+	Env string `json:"env" yaml:"env" comment:"Environment variable clients can set to request a working directory. Empty disables it."`
+	// AllowedPrefixes are the absolute directories under which clients may request a working directory. If empty,
+	// client requests are rejected. Symlinks in the requested directory and the prefixes are resolved in the container,
+	// and the directory is entered as the mapped user, so users can only start in directories they can access.
+	AllowedPrefixes []string `json:"allowedPrefixes" yaml:"allowedPrefixes" comment:"Directories under which clients may request a working directory."`
+}
+
+// SessionStopConfig configures how a program is stopped when its channel closes, the connection drops or the server
+// shuts down. Its stdin is closed first, then it is sent SIGTERM and finally SIGKILL, waiting after each step for the
+// program to exit. Signals are only sent if they are enabled in the pod configuration.
+type SessionStopConfig struct {
+	// StdinTimeout is how long to wait for the program to exit after closing its stdin.
+	StdinTimeout time.Duration `json:"stdinTimeout" yaml:"stdinTimeout" comment:"How long to wait for the program to exit after closing stdin." default:"2s"`
+	// TerminateTimeout is how long to wait for the program to exit after sending SIGTERM.
+	TerminateTimeout time.Duration `json:"terminateTimeout" yaml:"terminateTimeout" comment:"How long to wait for the program to exit after SIGTERM." default:"5s"`
+	// KillTimeout is how long to wait for the program to exit after sending SIGKILL before giving up on it.
+	KillTimeout time.Duration `json:"killTimeout" yaml:"killTimeout" comment:"How long to wait for the program to exit after SIGKILL." default:"5s"`
+}
+
+// OwnerMode selects the object set as the owner of the created pods.
+type OwnerMode string
+
+const (
+	// OwnerModeNone sets no owner reference.
+	OwnerModeNone OwnerMode = ""
+	// OwnerModeSelf sets the ContainerSSH pod as the owner. The pod name and namespace are read from the environment
+	// variables configured in OwnerConfig, which should be populated via the downward API.
+	OwnerModeSelf OwnerMode = "self"
+	// OwnerModeObject sets the object described by OwnerConfig as the owner.
+	OwnerModeObject OwnerMode = "object"
+	// OwnerModeConfigMap creates a ConfigMap for each connection and sets it as the owner. The ConfigMap is owned by
+	// the ContainerSSH pod if it can be found via the downward API. Workspace pods are not owned by the ConfigMap.
+	OwnerModeConfigMap OwnerMode = "configMap"
+)
+
+// OwnerConfig configures the owner reference set on created pods. The owner must be in the same namespace as the pod.
+type OwnerConfig struct {
+	// Mode selects the owner. See OwnerMode for the possible values.
+	Mode OwnerMode `json:"mode" yaml:"mode" comment:"Owner of the created pods: self, object or configMap. Empty sets no owner."`
+	// PodNameEnv is the environment variable containing the name of the ContainerSSH pod.
+	PodNameEnv string `json:"podNameEnv" yaml:"podNameEnv" comment:"Environment variable containing the ContainerSSH pod name." default:"POD_NAME"`
+	// PodNamespaceEnv is the environment variable containing the namespace of the ContainerSSH pod.
+	PodNamespaceEnv string `json:"podNamespaceEnv" yaml:"podNamespaceEnv" comment:"Environment variable containing the ContainerSSH pod namespace." default:"POD_NAMESPACE"`
+	// APIVersion is the API version of the owner object in object mode, e.g. apps/v1.
+	APIVersion string `json:"apiVersion" yaml:"apiVersion" comment:"API version of the owner object."`
+	// Kind is the kind of the owner object in object mode, e.g. Deployment.
+	Kind string `json:"kind" yaml:"kind" comment:"Kind of the owner object."`
+	// Resource is the plural resource name of the owner object in object mode, e.g. deployments.
+	Resource string `json:"resource" yaml:"resource" comment:"Resource name of the owner object."`
+	// Name is the name of the owner object in object mode.
+	Name string `json:"name" yaml:"name" comment:"Name of the owner object."`
+}
+
 // PodConfig describes the pod to launch.
 type PodConfig struct {
 	// Namespace is the namespace to run the pod in.
@@ -75,4 +397,105 @@ type PodConfig struct {
 	ShellCommand []string `json:"shellCommand" yaml:"shellCommand" comment:"Run this command when a new shell is requested." default:"[\"/bin/bash\"]"`
 	// IdleCommand contains the command to run as the first process in the container. Other commands are executed using the "exec" method.
 	IdleCommand []string `json:"idleCommand" yaml:"idleCommand" comment:"Run this command to wait for container exit" default:"[\"/bin/sh\", \"-c\", \"sleep infinity & PID=$!; trap \\\"kill $PID\\\" INT TERM; wait\"]"`
+	// OneShot runs the console container with the command from the pod spec instead of IdleCommand. The output of the
+	// console container is streamed to the first session channel and its exit code is returned as the exit status.
+	// The pod is created with the Never restart policy so the command runs only once.
+	OneShot bool `json:"oneShot" yaml:"oneShot" comment:"Stream the console container output to the first session instead of running IdleCommand." default:"false"`
+	// EnvCommand is the env binary in the console container. It is used to pass environment variables requested by the
+	// client, and the connection variables missing from the pod spec, to programs. Programs are only wrapped if there
+	// are variables to pass. Set it to an empty string for images without an env binary, which rejects client
+	// variables.
+	EnvCommand string `json:"envCommand" yaml:"envCommand" comment:"env binary used to pass environment variables to programs. Empty disables passing variables." default:"/usr/bin/env"`
+	// HelperShell is the POSIX shell in the console container used for the helper commands of ContainerSSH, such as
+	// reading the user database, detecting the shell, creating home directories and changing the working directory.
+	HelperShell string `json:"helperShell" yaml:"helperShell" comment:"POSIX shell used for helper commands in the pod." default:"/bin/sh"`
+	// AutoShell detects the shell for shell requests instead of using ShellCommand.
+	AutoShell AutoShellConfig `json:"autoShell" yaml:"autoShell" comment:"Detect the shell for shell requests"`
+	// ExecMode selects how the commands of exec requests are run. See ExecMode for the possible values.
+	ExecMode ExecMode `json:"execMode" yaml:"execMode" comment:"How to run exec commands: auto, shell, argv or login." default:"auto"`
+	// ExecShell is the shell running the commands of exec requests in the shell and login modes. Set it to
+	// passwd to use the login shell of the container user from /etc/passwd.
+	ExecShell string `json:"execShell" yaml:"execShell" comment:"Shell for exec commands, or passwd to read it from /etc/passwd." default:"/bin/sh"`
+	// Signals configures the delivery of signals from the client to running programs.
+	Signals SignalConfig `json:"signals" yaml:"signals" comment:"Signal delivery to running programs"`
+	// Metadata mounts fields of the pod, such as its labels and annotations, into the console container.
+	Metadata MetadataConfig `json:"metadata" yaml:"metadata" comment:"Downward API volume with the pod metadata"`
+	// InitCommands run in order in each new pod after it becomes ready and the home directory of the mapped user was
+	// created, and before sessions can start. Workspace pods are only initialized once. Init commands are not run in
+	// one-shot mode.
+	InitCommands []PodCommand `json:"initCommands" yaml:"initCommands" comment:"Commands to run in each new pod before sessions start."`
+	// LogoutCommands run in order when the client disconnects, before the pod is removed. Failures are logged and the
+	// pod is removed regardless. The failure policy of the commands is ignored.
+	LogoutCommands []PodCommand `json:"logoutCommands" yaml:"logoutCommands" comment:"Commands to run in the pod when the client disconnects."`
+}
+
+// AutoShellConfig configures the detection of the shell for shell requests. The console container is probed once
+// after it becomes ready for the first available shell from the list.
+type AutoShellConfig struct {
+	// Enable probes the console container for a shell and uses it instead of ShellCommand.
+	Enable bool `json:"enable" yaml:"enable" comment:"Probe the console container for a shell instead of using ShellCommand." default:"false"`
+	// Candidates are the shells to look for in order of preference, as names looked up in the PATH or as paths.
+	Candidates []string `json:"candidates" yaml:"candidates" comment:"Shells to look for in order of preference." default:"[\"bash\",\"zsh\",\"ash\",\"sh\"]"`
+}
+
+// ExecMode selects how the command of an exec request is turned into the program to execute.
+type ExecMode string
+
+const (
+	// ExecModeAuto runs commands starting with /, ./ or ../ directly and all other commands with /bin/sh -c. This is
+	// the behavior of earlier versions.
+	ExecModeAuto ExecMode = "auto"
+	// ExecModeShell runs all commands with ExecShell -c.
+	ExecModeShell ExecMode = "shell"
+	// ExecModeArgv splits commands into arguments and runs them directly without a shell. Commands containing shell
+	// operators are rejected. This is suitable for images without a shell.
+	ExecModeArgv ExecMode = "argv"
+	// ExecModeLogin runs all commands with ExecShell -lc, so the login profile of the shell is loaded.
+	ExecModeLogin ExecMode = "login"
+)
+
+// SignalConfig configures signal delivery. Each program is started through a shell that records its PID in a file,
+// and signals are sent with a second exec running kill. This requires a POSIX shell in the console container.
+type SignalConfig struct {
+	// Enable starts programs through the launcher and delivers signals requested by the client. This requires the
+	// shell in the console container and starts every program through it, so it is disabled by default.
+	Enable bool `json:"enable" yaml:"enable" comment:"Deliver signals from the client to running programs." default:"false"`
+	// Shell is the POSIX shell used to launch programs and send signals.
+	Shell string `json:"shell" yaml:"shell" comment:"POSIX shell used to launch programs and send signals." default:"/bin/sh"`
+	// PIDDirectory is the directory in the container where the PID files of the programs are stored. It is created
+	// accessible only to the container user. Programs are not started if it exists and belongs to another user.
+	PIDDirectory string `json:"pidDirectory" yaml:"pidDirectory" comment:"Private directory for the PID files of programs." default:"/tmp/containerssh"`
+}
+
+// MetadataConfig configures a downward API volume with metadata of the pod in the console container. The labels and
+// annotations include the connection details.
+type MetadataConfig struct {
+	// Enable mounts the volume.
+	Enable bool `json:"enable" yaml:"enable" comment:"Mount the pod metadata into the console container." default:"false"`
+	// MountPath is the directory the files are mounted to.
+	MountPath string `json:"mountPath" yaml:"mountPath" comment:"Directory to mount the pod metadata to." default:"/etc/containerssh"`
+	// Files maps the file names in the volume to the downward API field paths, e.g. metadata.labels.
+	Files map[string]string `json:"files" yaml:"files" comment:"File names and downward API field paths." default:"{\"labels\":\"metadata.labels\",\"annotations\":\"metadata.annotations\"}"`
+}
+
+// PodCommandFailurePolicy decides what happens when a command executed in the pod outside of a session fails.
+type PodCommandFailurePolicy string
+
+const (
+	// PodCommandFailureAbort aborts the connection if the command fails.
+	PodCommandFailureAbort PodCommandFailurePolicy = "abort"
+	// PodCommandFailureContinue logs the failure and continues with the next command.
+	PodCommandFailureContinue PodCommandFailurePolicy = "continue"
+)
+
+// PodCommand is a command executed in the pod outside of a session. Its output is written to the logs.
+type PodCommand struct {
+	// Command is the program and its arguments to execute.
+	Command []string `json:"command" yaml:"command" comment:"Program and arguments to execute."`
+	// Container is the name of the container to run the command in. Defaults to the console container.
+	Container string `json:"container" yaml:"container" comment:"Container to run the command in. Defaults to the console container."`
+	// Timeout is how long the command may run. Defaults to the pod creation timeout.
+	Timeout time.Duration `json:"timeout" yaml:"timeout" comment:"How long the command may run. Defaults to the pod creation timeout."`
+	// OnFailure decides whether the connection is aborted if the command fails. Defaults to abort.
+	OnFailure PodCommandFailurePolicy `json:"onFailure" yaml:"onFailure" comment:"abort or continue if the command fails. Defaults to abort."`
 }
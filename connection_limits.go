@@ -0,0 +1,151 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerssh/sshserver"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// exitStatusTimeout is the exit status of sessions closed because of the maximum connection duration or the idle
+// timeout. It matches the exit status of the timeout command.
+const exitStatusTimeout sshserver.ExitStatus = 124
+
+// podDeadlineExceededReason is the reason Kubernetes sets on pods that ran longer than their activeDeadlineSeconds.
+const podDeadlineExceededReason = "DeadlineExceeded"
+
+// activeDeadlineSeconds returns the activeDeadlineSeconds for a pod that has been running since startTime, so that it
+// is stopped MaxConnectionDuration from now. It returns nil if the connection duration is not limited.
+func activeDeadlineSeconds(config Config, startTime *meta.Time) *int64 {
+	if config.MaxConnectionDuration <= 0 {
+		return nil
+	}
+	duration := config.MaxConnectionDuration
+	if startTime != nil {
+		duration += time.Since(startTime.Time)
+	}
+	seconds := int64(math.Ceil(duration.Seconds()))
+	return &seconds
+}
+
+// connectionDeadline returns the time the pod will be stopped by Kubernetes, and false if the pod has no deadline.
+func connectionDeadline(pod *core.Pod) (time.Time, bool) {
+	if pod.Spec.ActiveDeadlineSeconds == nil {
+		return time.Time{}, false
+	}
+	startTime := time.Now()
+	if pod.Status.StartTime != nil {
+		startTime = pod.Status.StartTime.Time
+	}
+	return startTime.Add(time.Duration(*pod.Spec.ActiveDeadlineSeconds) * time.Second), true
+}
+
+// startConnectionLimits enforces the maximum connection duration of the pod and the idle timeout until the context is
+// cancelled.
+func (n *networkHandler) startConnectionLimits(ctx context.Context, pod *core.Pod) {
+	if deadline, ok := connectionDeadline(pod); ok {
+		go n.enforceMaxConnectionDuration(ctx, deadline)
+	}
+	if n.config.IdleTimeout > 0 {
+		n.recordActivity()
+		go n.enforceIdleTimeout(ctx)
+	}
+}
+
+// enforceMaxConnectionDuration warns the user in all running sessions before the deadline and closes the connection
+// when it is reached. Kubernetes stops the pod at the same time.
+func (n *networkHandler) enforceMaxConnectionDuration(ctx context.Context, deadline time.Time) {
+	warningTime := deadline.Add(-n.config.MaxConnectionDurationWarning)
+	if n.config.MaxConnectionDurationWarning > 0 && time.Now().Before(warningTime) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(warningTime)):
+		}
+		n.warnSessions(fmt.Sprintf(
+			"this connection will be closed in %s because it reached the maximum connection duration",
+			n.config.MaxConnectionDurationWarning,
+		))
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(deadline)):
+	}
+	n.logger.Noticef("maximum connection duration reached, closing connection")
+	n.closeConnection(ctx, fmt.Errorf("the maximum connection duration was reached"), exitStatusTimeout)
+}
+
+// warnSessions writes a warning to all running sessions without closing them.
+func (n *networkHandler) warnSessions(message string) {
+	n.mutex.Lock()
+	channels := n.runningChannels()
+	n.mutex.Unlock()
+	for _, channel := range channels {
+		channel.message(message)
+	}
+}
+
+// enforceIdleTimeout closes the connection once there was no stdin or stdout traffic on any session for the idle
+// timeout.
+func (n *networkHandler) enforceIdleTimeout(ctx context.Context) {
+	for {
+		idle := time.Since(n.lastActivity())
+		if idle >= n.config.IdleTimeout {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(n.config.IdleTimeout - idle):
+		}
+	}
+	n.logger.Noticef("connection idle for %s, closing connection", n.config.IdleTimeout)
+	n.closeConnection(
+		ctx,
+		fmt.Errorf("the connection was closed after being idle for %s", n.config.IdleTimeout),
+		exitStatusTimeout,
+	)
+}
+
+// recordActivity records that there was traffic on a session of the connection.
+func (n *networkHandler) recordActivity() {
+	atomic.StoreInt64(&n.lastActivityTime, time.Now().UnixNano())
+}
+
+func (n *networkHandler) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&n.lastActivityTime))
+}
+
+// activityReader records the activity on the connection whenever data is read.
+type activityReader struct {
+	reader         io.Reader
+	networkHandler *networkHandler
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.reader.Read(p)
+	if n > 0 {
+		a.networkHandler.recordActivity()
+	}
+	return n, err
+}
+
+// activityWriter records the activity on the connection whenever data is written.
+type activityWriter struct {
+	writer         io.Writer
+	networkHandler *networkHandler
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		a.networkHandler.recordActivity()
+	}
+	return a.writer.Write(p)
+}
@@ -0,0 +1,83 @@
+package kuberun
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/sshserver"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestActiveDeadlineSecondsShouldIncludeRunningTime(t *testing.T) {
+	config := Config{MaxConnectionDuration: time.Hour}
+	assert.Equal(t, int64(3600), *activeDeadlineSeconds(config, nil))
+
+	startTime := meta.NewTime(time.Now().Add(-10 * time.Minute))
+	seconds := *activeDeadlineSeconds(config, &startTime)
+	assert.GreaterOrEqual(t, seconds, int64(4200))
+	assert.Less(t, seconds, int64(4210))
+
+	assert.Nil(t, activeDeadlineSeconds(Config{}, nil))
+}
+
+func TestDeadlineExceededPodShouldReportTimeout(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase:  core.PodFailed,
+			Reason: podDeadlineExceededReason,
+		},
+	}
+
+	reason, exitStatus := n.podGoneReason(watch.Event{Type: watch.Modified, Object: pod})
+	assert.Contains(t, reason, "maximum connection duration")
+	assert.Equal(t, exitStatusTimeout, exitStatus)
+}
+
+func TestIdleTimeoutShouldCloseSessions(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.IdleTimeout = 50 * time.Millisecond
+	n.pod = &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "test"}}
+	stderr := &bytes.Buffer{}
+	exitStatuses := make(chan sshserver.ExitStatus, 1)
+	programContext, cancelProgram := context.WithCancel(context.Background())
+	defer cancelProgram()
+	channel := &channelHandler{
+		networkHandler: n,
+		channelID:      1,
+		stderr:         stderr,
+		onExit: func(exitStatus sshserver.ExitStatus) {
+			exitStatuses <- exitStatus
+		},
+		cancelProgram: cancelProgram,
+	}
+	n.mutex.Lock()
+	channel.start()
+	n.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.startConnectionLimits(ctx, n.pod)
+
+	select {
+	case exitStatus := <-exitStatuses:
+		assert.Equal(t, exitStatusTimeout, exitStatus)
+		assert.Contains(t, stderr.String(), "idle")
+		assert.Error(t, n.closed)
+		assert.Error(t, programContext.Err())
+		assert.Contains(t, stderr.String(), "reconnect")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle session was not closed")
+	}
+
+	sshHandler := &sshConnectionHandler{networkHandler: n, mutex: &sync.Mutex{}}
+	_, rejection := sshHandler.OnSessionChannel(2, nil)
+	assert.NotNil(t, rejection)
+	assert.Contains(t, rejection.Message(), "reconnect")
+}
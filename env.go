@@ -0,0 +1,186 @@
+package kuberun
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	envUsername     = "CONTAINERSSH_USERNAME"
+	envConnectionID = "CONTAINERSSH_CONNECTION_ID"
+	envClientIP     = "CONTAINERSSH_CLIENT_IP"
+	envProfile      = "CONTAINERSSH_PROFILE"
+
+	metadataVolumeName = "containerssh-metadata"
+)
+
+// alwaysDeniedEnv contains glob patterns of variable names that clients may never set, regardless of the policy. They
+// change how programs are loaded or which programs run.
+var alwaysDeniedEnv = []string{"LD_*", "BASH_ENV", "ENV", "PATH"}
+
+// envNamePattern matches the environment variable names that can be passed safely to the env command.
+var envNamePattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// checkEnv returns an error if the environment policy does not allow the client to set the variable in a session that
+// already has the variables in env.
+func (n *networkHandler) checkEnv(env map[string]string, name string, value string) error {
+	policy := n.config.Env
+	if n.config.Pod.EnvCommand == "" {
+		return fmt.Errorf("environment variables are not supported by the server")
+	}
+	if !envNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid environment variable name")
+	}
+	if matchesPattern(alwaysDeniedEnv, name) || matchesPattern(policy.Deny, name) {
+		return fmt.Errorf("environment variable %s is denied by the server", name)
+	}
+	if !matchesPattern(policy.Allow, name) {
+		return fmt.Errorf("environment variable %s is not allowed by the server", name)
+	}
+	if policy.MaxValueLength > 0 && len(value) > policy.MaxValueLength {
+		return fmt.Errorf(
+			"the value of environment variable %s is longer than %d bytes",
+			name,
+			policy.MaxValueLength,
+		)
+	}
+	if policy.MaxSessionSize > 0 {
+		size := len(name) + len(value)
+		for existingName, existingValue := range env {
+			if existingName != name {
+				size += len(existingName) + len(existingValue)
+			}
+		}
+		if size > policy.MaxSessionSize {
+			return fmt.Errorf("the environment variables of the session exceed %d bytes", policy.MaxSessionSize)
+		}
+	}
+	return nil
+}
+
+// matchesPattern returns true if the name matches any of the glob patterns.
+func matchesPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionEnv returns the environment variables describing the connection. If sharedPod is true, the variables
+// that differ between the connections sharing the pod are left out.
+func (n *networkHandler) connectionEnv(sharedPod bool) map[string]string {
+	env := map[string]string{
+		envUsername: n.username,
+	}
+	if n.config.Profile != "" {
+		env[envProfile] = n.config.Profile
+	}
+	if !sharedPod {
+		env[envConnectionID] = n.connectionID
+		env[envClientIP] = n.client.IP.String()
+	}
+	return env
+}
+
+// addConnectionEnv adds the environment variables describing the connection to the console container of the spec.
+func (n *networkHandler) addConnectionEnv(spec *core.PodSpec, sharedPod bool) {
+	env := n.connectionEnv(sharedPod)
+	container := &spec.Containers[n.config.Pod.ConsoleContainerNumber]
+	for _, name := range sortedEnvNames(env) {
+		container.Env = append(container.Env, core.EnvVar{Name: name, Value: env[name]})
+	}
+}
+
+// execConnectionEnv returns the variables describing the connection that are not already set in the console container
+// of the pod, e.g. because the pod is shared by several connections or was taken from the warm pool.
+func (n *networkHandler) execConnectionEnv() map[string]string {
+	env := n.connectionEnv(false)
+	pod := n.currentPod()
+	if pod == nil {
+		return env
+	}
+	consoleContainer := n.config.Pod.Spec.Containers[n.config.Pod.ConsoleContainerNumber].Name
+	for _, container := range pod.Spec.Containers {
+		if container.Name != consoleContainer {
+			continue
+		}
+		for _, envVar := range container.Env {
+			if value, ok := env[envVar.Name]; ok && value == envVar.Value && envVar.ValueFrom == nil {
+				delete(env, envVar.Name)
+			}
+		}
+	}
+	return env
+}
+
+// wrapEnv prefixes the program with the env command so it runs with the specified variables, since Kubernetes exec
+// has no way to pass environment variables. The variables are passed as separate arguments, so no shell quoting is
+// involved. Variables with names the env command could misinterpret are left out. Programs are not wrapped if there
+// are no variables to pass, or if the env command is disabled.
+func (n *networkHandler) wrapEnv(env map[string]string, program []string) []string {
+	if len(env) == 0 {
+		return program
+	}
+	if n.config.Pod.EnvCommand == "" {
+		n.logger.Debugf("not passing %d environment variables, the env command is disabled", len(env))
+		return program
+	}
+	wrapped := []string{n.config.Pod.EnvCommand}
+	for _, name := range sortedEnvNames(env) {
+		if !envNamePattern.MatchString(name) {
+			n.logger.Debugf("not passing environment variable with invalid name %q", name)
+			continue
+		}
+		wrapped = append(wrapped, name+"="+env[name])
+	}
+	return append(wrapped, program...)
+}
+
+// sortedEnvNames returns the names of the variables in a stable order.
+func sortedEnvNames(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addMetadataVolume mounts the configured downward API fields, such as the labels and annotations of the pod, into
+// the console container.
+func addMetadataVolume(config Config, spec *core.PodSpec) {
+	metadata := config.Pod.Metadata
+	if !metadata.Enable || len(metadata.Files) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(metadata.Files))
+	for path := range metadata.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	items := make([]core.DownwardAPIVolumeFile, 0, len(paths))
+	for _, path := range paths {
+		items = append(items, core.DownwardAPIVolumeFile{
+			Path:     path,
+			FieldRef: &core.ObjectFieldSelector{FieldPath: metadata.Files[path]},
+		})
+	}
+	spec.Volumes = append(spec.Volumes, core.Volume{
+		Name: metadataVolumeName,
+		VolumeSource: core.VolumeSource{
+			DownwardAPI: &core.DownwardAPIVolumeSource{Items: items},
+		},
+	})
+	container := &spec.Containers[config.Pod.ConsoleContainerNumber]
+	container.VolumeMounts = append(container.VolumeMounts, core.VolumeMount{
+		Name:      metadataVolumeName,
+		MountPath: metadata.MountPath,
+		ReadOnly:  true,
+	})
+}
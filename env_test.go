@@ -0,0 +1,162 @@
+package kuberun
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+func TestWrapEnvShouldPassVariablesAsArguments(t *testing.T) {
+	n := newTestNetworkHandler(t)
+
+	program := n.wrapEnv(
+		map[string]string{
+			"LANG":    "en_US.UTF-8",
+			"MESSAGE": "it's a \"quoted\" $value; rm -rf /",
+			"A=B":     "invalid",
+		},
+		[]string{"/bin/bash", "-c", "echo $MESSAGE"},
+	)
+	assert.Equal(t, []string{
+		"/usr/bin/env",
+		"LANG=en_US.UTF-8",
+		"MESSAGE=it's a \"quoted\" $value; rm -rf /",
+		"/bin/bash",
+		"-c",
+		"echo $MESSAGE",
+	}, program)
+}
+
+func TestConnectionEnvShouldOmitConnectionDetailsOnSharedPods(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "foo"
+	n.connectionID = "0123"
+	n.client = net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	env := n.connectionEnv(false)
+	assert.Equal(t, "foo", env[envUsername])
+	assert.Equal(t, "0123", env[envConnectionID])
+	assert.Equal(t, "127.0.0.1", env[envClientIP])
+
+	env = n.connectionEnv(true)
+	assert.Equal(t, "foo", env[envUsername])
+	assert.NotContains(t, env, envConnectionID)
+	assert.NotContains(t, env, envClientIP)
+}
+
+func TestMetadataVolumeShouldBeMountedInConsoleContainer(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.Metadata.Enable = true
+
+	spec := createPodSpec(n.config)
+	assert.Len(t, spec.Volumes, 1)
+	assert.Len(t, spec.Volumes[0].DownwardAPI.Items, 2)
+	assert.Equal(t, "annotations", spec.Volumes[0].DownwardAPI.Items[0].Path)
+	assert.Equal(t, "metadata.annotations", spec.Volumes[0].DownwardAPI.Items[0].FieldRef.FieldPath)
+	mounts := spec.Containers[n.config.Pod.ConsoleContainerNumber].VolumeMounts
+	assert.Len(t, mounts, 1)
+	assert.Equal(t, "/etc/containerssh", mounts[0].MountPath)
+}
+
+func TestSessionEnvShouldBePassedToProgram(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "foo"
+	c := &channelHandler{
+		networkHandler: n,
+		sshHandler:     &sshConnectionHandler{networkHandler: n, mutex: &sync.Mutex{}},
+		env:            map[string]string{},
+	}
+	assert.NoError(t, c.OnPtyRequest(0, "xterm-256color", 80, 25, 0, 0, nil))
+	assert.NoError(t, c.OnEnvRequest(0, "LANG", "en_US.UTF-8"))
+	assert.NoError(t, c.OnEnvRequest(0, "GIT_AUTHOR_NAME", "Foo Bar"))
+	assert.Error(t, c.OnEnvRequest(0, envUsername, "spoofed"))
+
+	program := n.wrapEnv(c.programEnv(), []string{"/bin/bash"})
+	assert.Equal(t, "/usr/bin/env", program[0])
+	assert.Contains(t, program, "TERM=xterm-256color")
+	assert.Contains(t, program, "LANG=en_US.UTF-8")
+	assert.Contains(t, program, "GIT_AUTHOR_NAME=Foo Bar")
+	assert.Contains(t, program, envUsername+"=foo")
+	assert.NotContains(t, program, envUsername+"=spoofed")
+	assert.Equal(t, "/bin/bash", program[len(program)-1])
+}
+
+func TestEnvPolicyShouldRejectVariables(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Env.Allow = []string{"LANG", "LC_*", "GIT_*"}
+	n.config.Env.MaxValueLength = 8
+	n.config.Env.MaxSessionSize = 32
+
+	assert.NoError(t, n.checkEnv(map[string]string{}, "LC_ALL", "C"))
+	assert.NoError(t, n.checkEnv(map[string]string{}, "GIT_DIR", "/tmp"))
+	assert.Error(t, n.checkEnv(map[string]string{}, "LD_PRELOAD", "/tmp/x.so"))
+	assert.Error(t, n.checkEnv(map[string]string{}, "CONTAINERSSH_USERNAME", "root"))
+	assert.Error(t, n.checkEnv(map[string]string{}, "LANG", "en_US.UTF-8"))
+	assert.Error(t, n.checkEnv(map[string]string{}, "LC-ALL", "C"))
+	assert.Error(t, n.checkEnv(
+		map[string]string{"GIT_AUTHOR_NAME": "Foo Bar", "GIT_DIR": "/tmp"},
+		"LC_ALL",
+		"C.UTF-8",
+	))
+}
+
+func TestDangerousEnvShouldAlwaysBeDenied(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Env.Allow = []string{"*"}
+	n.config.Env.Deny = nil
+
+	for _, name := range []string{"LD_PRELOAD", "LD_LIBRARY_PATH", "BASH_ENV", "ENV", "PATH"} {
+		assert.Error(t, n.checkEnv(map[string]string{}, name, "/tmp/x"), name)
+	}
+	assert.NoError(t, n.checkEnv(map[string]string{}, "EDITOR", "vim"))
+}
+
+func TestForcedEnvShouldOverrideClient(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Env.Force = map[string]string{"LANG": "C.UTF-8"}
+	c := &channelHandler{
+		networkHandler: n,
+		sshHandler:     &sshConnectionHandler{networkHandler: n, mutex: &sync.Mutex{}},
+		env:            map[string]string{},
+	}
+	assert.NoError(t, c.OnEnvRequest(0, "LANG", "de_DE.UTF-8"))
+
+	assert.Equal(t, "C.UTF-8", c.programEnv()["LANG"])
+}
+
+func TestConnectionEnvInPodSpecShouldNotBeWrapped(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "foo"
+	n.connectionID = "0123"
+	n.client = net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	spec := createPodSpec(n.config)
+	n.addConnectionEnv(spec, false)
+	n.pod = &core.Pod{Spec: *spec}
+	c := newTestChannelHandler(n)
+
+	program := n.wrapEnv(c.programEnv(), []string{"/bin/ls"})
+	assert.Equal(t, []string{"/bin/ls"}, program)
+
+	spec = createPodSpec(n.config)
+	n.addConnectionEnv(spec, true)
+	n.pod = &core.Pod{Spec: *spec}
+	program = n.wrapEnv(c.programEnv(), []string{"/bin/ls"})
+	assert.Equal(t, []string{
+		"/usr/bin/env",
+		envClientIP + "=127.0.0.1",
+		envConnectionID + "=0123",
+		"/bin/ls",
+	}, program)
+}
+
+func TestDisabledEnvCommandShouldRejectClientEnv(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.EnvCommand = ""
+	c := newTestChannelHandler(n)
+
+	assert.Error(t, c.OnEnvRequest(0, "LANG", "C"))
+	assert.Equal(t, []string{"/bin/ls"}, n.wrapEnv(map[string]string{"LANG": "C"}, []string{"/bin/ls"}))
+}
@@ -0,0 +1,53 @@
+package kuberun
+
+import (
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCore "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventReasonConnected      = "ContainerSSHConnected"
+	eventReasonSessionStarted = "ContainerSSHSessionStarted"
+	eventReasonSessionExited  = "ContainerSSHSessionExited"
+	eventReasonDisconnected   = "ContainerSSHDisconnected"
+)
+
+// startEventRecorder creates a rate-limited recorder for Kubernetes events about the connection if events are enabled.
+func (n *networkHandler) startEventRecorder() {
+	if !n.config.Events.Enable {
+		return
+	}
+	n.eventBroadcaster = record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		QPS:       n.config.Events.QPS,
+		BurstSize: n.config.Events.Burst,
+	})
+	n.eventBroadcaster.StartRecordingToSink(&typedCore.EventSinkImpl{
+		Interface: n.cli.CoreV1().Events(n.config.Pod.Namespace),
+	})
+	n.eventRecorder = n.eventBroadcaster.NewRecorder(scheme.Scheme, core.EventSource{
+		Component: "containerssh",
+		Host:      instanceID(n.config),
+	})
+}
+
+// stopEventRecorder stops the event recorder. Events already queued are still sent.
+func (n *networkHandler) stopEventRecorder() {
+	if n.eventBroadcaster != nil {
+		n.eventBroadcaster.Shutdown()
+	}
+}
+
+// recordEvent records a Kubernetes event against the pod of the connection. It does nothing if events are disabled
+// or there is no pod.
+func (n *networkHandler) recordEvent(eventType string, reason string, messageFmt string, args ...interface{}) {
+	if n.eventRecorder == nil {
+		return
+	}
+	pod := n.currentPod()
+	if pod == nil {
+		return
+	}
+	n.eventRecorder.Eventf(pod, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,42 @@
+package kuberun
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventsShouldBeRecordedAgainstPod(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Events.Enable = true
+	n.cli = fake.NewSimpleClientset()
+	n.pod = &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "test", Namespace: "default", UID: "1234"}}
+	n.startEventRecorder()
+	defer n.stopEventRecorder()
+
+	n.recordEvent(core.EventTypeNormal, eventReasonSessionExited, "Session %d exited with status %d", 1, 0)
+
+	assert.Eventually(t, func() bool {
+		events, err := n.cli.CoreV1().Events("default").List(context.Background(), meta.ListOptions{})
+		if err != nil || len(events.Items) != 1 {
+			return false
+		}
+		event := events.Items[0]
+		return event.InvolvedObject.Name == "test" && event.Reason == eventReasonSessionExited
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestEventsShouldBeDisabledByDefault(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.cli = fake.NewSimpleClientset()
+	n.pod = &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "test", Namespace: "default"}}
+	n.startEventRecorder()
+
+	n.recordEvent(core.EventTypeNormal, eventReasonConnected, "connected")
+	assert.Nil(t, n.eventRecorder)
+}
@@ -0,0 +1,118 @@
+package kuberun
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containerssh/sshserver"
+	"golang.org/x/crypto/ssh"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	execUtil "k8s.io/client-go/util/exec"
+)
+
+// exitStatusKilled is the exit status of sessions whose pod went away, as if the program received SIGKILL.
+const exitStatusKilled sshserver.ExitStatus = 128 + 9
+
+// execFailure describes why a program could not be run or streamed, with the exit status and the message for the user.
+type execFailure struct {
+	exitStatus sshserver.ExitStatus
+	message    string
+}
+
+// classifyExecError maps the error returned by an exec stream to the exit status reported to the client. Programs
+// that exited on their own keep their exit code, and programs killed by a signal are reported with 128 plus the
+// signal number, as the exec API does not tell them apart; see reportExit. Errors before the program started are
+// reported as setup failures, and errors while streaming as stream failures, each with a message for the user.
+func (n *networkHandler) classifyExecError(err error) (sshserver.ExitStatus, *execFailure) {
+	exitErr := execUtil.CodeExitError{}
+	if errors.As(err, &exitErr) {
+		exitStatus := sshserver.ExitStatus(exitErr.Code)
+		if name := signalName(exitStatus); name != "" {
+			n.logger.Debugf("program was terminated by signal %s (exit status %d)", name, exitStatus)
+		}
+		return exitStatus, nil
+	}
+	if isExecSetupError(err) {
+		return n.config.ExitStatus.SetupFailure, &execFailure{
+			exitStatus: n.config.ExitStatus.SetupFailure,
+			message:    fmt.Sprintf("failed to start the program in the pod: %v", err),
+		}
+	}
+	return n.config.ExitStatus.StreamFailure, &execFailure{
+		exitStatus: n.config.ExitStatus.StreamFailure,
+		message:    fmt.Sprintf("the connection to the program in the pod was interrupted: %v", err),
+	}
+}
+
+// isExecSetupError returns true if the error happened before the program was started, for example because the
+// container is not running.
+func isExecSetupError(err error) bool {
+	var statusErr k8sErrors.APIStatus
+	if errors.As(err, &statusErr) {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "unable to upgrade connection")
+}
+
+// exitStatusMessage returns the explanation written to the stderr of the session for exit statuses that the shell
+// uses to report that the program could not be run, or an empty string for other statuses.
+func exitStatusMessage(exitStatus sshserver.ExitStatus) string {
+	switch exitStatus {
+	case 126:
+		return "command not executable (exit status 126)"
+	case 127:
+		return "command not found (exit status 127)"
+	}
+	return ""
+}
+
+// exitSignalPayload is the payload of the exit-signal request defined in RFC 4254 section 6.10.
+type exitSignalPayload struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Language   string
+}
+
+// reportExit reports how the program of an exec or subsystem session ended before the exit status is sent. Programs
+// killed by a signal are reported with an exit-signal request on the channel; the exit status sent afterwards is the
+// fallback for clients that ignore it. Statuses the shell uses for programs that could not be run are explained on
+// stderr. Nothing is reported for shell sessions, since the exit status of an interactive shell is that of the last
+// command the user ran, which says nothing about the session itself.
+func (c *channelHandler) reportExit(exitStatus sshserver.ExitStatus) {
+	c.networkHandler.mutex.Lock()
+	sessionType := c.sessionType
+	channel := c.channel
+	c.networkHandler.mutex.Unlock()
+	if sessionType == "shell" {
+		return
+	}
+	if name := signalName(exitStatus); name != "" {
+		if channel == nil {
+			return
+		}
+		payload := ssh.Marshal(exitSignalPayload{Signal: name})
+		if _, err := channel.SendRequest("exit-signal", false, payload); err != nil {
+			c.networkHandler.logger.Debugf("failed to send exit-signal on channel %d (%v)", c.channelID, err)
+		}
+		return
+	}
+	if message := exitStatusMessage(exitStatus); message != "" {
+		c.message(message)
+	}
+}
+
+// signalName returns the name of the signal that terminated a program with the exit status, following the 128 plus
+// signal number convention of the shell, or an empty string if the status does not indicate a signal.
+func signalName(exitStatus sshserver.ExitStatus) string {
+	if exitStatus <= 128 {
+		return ""
+	}
+	for name, number := range signalNumbers {
+		if sshserver.ExitStatus(128+number) == exitStatus {
+			return name
+		}
+	}
+	return ""
+}
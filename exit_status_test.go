@@ -0,0 +1,94 @@
+package kuberun
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/containerssh/sshserver"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	execUtil "k8s.io/client-go/util/exec"
+)
+
+func TestExecErrorsShouldBeClassified(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	assert.Equal(t, sshserver.ExitStatus(254), n.config.ExitStatus.SetupFailure)
+	assert.Equal(t, sshserver.ExitStatus(255), n.config.ExitStatus.StreamFailure)
+
+	exitStatus, failure := n.classifyExecError(execUtil.CodeExitError{Err: fmt.Errorf("exit"), Code: 127})
+	assert.Nil(t, failure)
+	assert.Equal(t, sshserver.ExitStatus(127), exitStatus)
+
+	exitStatus, failure = n.classifyExecError(
+		k8sErrors.NewBadRequest("container shell is not valid for pod test"),
+	)
+	assert.NotNil(t, failure)
+	assert.Equal(t, n.config.ExitStatus.SetupFailure, exitStatus)
+
+	exitStatus, failure = n.classifyExecError(
+		fmt.Errorf("wrapped (%w)", k8sErrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "test")),
+	)
+	assert.NotNil(t, failure)
+	assert.Equal(t, n.config.ExitStatus.SetupFailure, exitStatus)
+
+	exitStatus, failure = n.classifyExecError(fmt.Errorf("error reading from error stream: EOF"))
+	assert.NotNil(t, failure)
+	assert.Equal(t, n.config.ExitStatus.StreamFailure, exitStatus)
+	assert.Contains(t, failure.message, "interrupted")
+}
+
+func TestSignalNameShouldFollowShellConvention(t *testing.T) {
+	assert.Equal(t, "INT", signalName(130))
+	assert.Equal(t, "KILL", signalName(exitStatusKilled))
+	assert.Equal(t, "", signalName(1))
+	assert.Equal(t, "", signalName(128))
+}
+
+func TestExitStatusMessageShouldExplainShellStatuses(t *testing.T) {
+	assert.Contains(t, exitStatusMessage(127), "command not found")
+	assert.Contains(t, exitStatusMessage(126), "not executable")
+	assert.Equal(t, "", exitStatusMessage(130))
+	assert.Equal(t, "", exitStatusMessage(1))
+}
+
+type recordingChannel struct {
+	requests []string
+	payloads [][]byte
+}
+
+func (r *recordingChannel) SendRequest(name string, _ bool, payload []byte) (bool, error) {
+	r.requests = append(r.requests, name)
+	r.payloads = append(r.payloads, payload)
+	return false, nil
+}
+
+func TestKilledProgramShouldBeReportedWithExitSignal(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	c := newTestChannelHandler(n)
+	channel := &recordingChannel{}
+	c.channel = channel
+	stderr := &bytes.Buffer{}
+	c.stderr = stderr
+
+	c.sessionType = "exec"
+	c.reportExit(exitStatusKilled)
+	assert.Equal(t, []string{"exit-signal"}, channel.requests)
+	payload := exitSignalPayload{}
+	assert.NoError(t, ssh.Unmarshal(channel.payloads[0], &payload))
+	assert.Equal(t, exitSignalPayload{Signal: "KILL"}, payload)
+	assert.Empty(t, stderr.String())
+
+	c.reportExit(127)
+	assert.Contains(t, stderr.String(), "command not found")
+
+	stderr.Reset()
+	channel.requests = nil
+	c.sessionType = "shell"
+	c.reportExit(130)
+	c.reportExit(127)
+	assert.Empty(t, channel.requests)
+	assert.Empty(t, stderr.String())
+}
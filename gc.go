@@ -0,0 +1,323 @@
+package kuberun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	instanceAnnotation  = "containerssh.io/instance"
+	heartbeatAnnotation = "containerssh.io/heartbeat"
+)
+
+// activeConnections contains the IDs of the connections currently handled by this process.
+var activeConnections = map[string]struct{}{}
+var activeConnectionsMutex = &sync.Mutex{}
+
+func registerConnection(connectionID string) {
+	activeConnectionsMutex.Lock()
+	defer activeConnectionsMutex.Unlock()
+	activeConnections[connectionID] = struct{}{}
+}
+
+func unregisterConnection(connectionID string) {
+	activeConnectionsMutex.Lock()
+	defer activeConnectionsMutex.Unlock()
+	delete(activeConnections, connectionID)
+}
+
+func isConnectionActive(connectionID string) bool {
+	activeConnectionsMutex.Lock()
+	defer activeConnectionsMutex.Unlock()
+	_, ok := activeConnections[connectionID]
+	return ok
+}
+
+// instanceID returns the identifier of this ContainerSSH instance. It defaults to the hostname, which is the pod name
+// when running in Kubernetes.
+func instanceID(config Config) string {
+	if config.GC.InstanceID != "" {
+		return config.GC.InstanceID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// ownerAnnotations returns the annotations that record the owning instance and the initial heartbeat on a new pod.
+func (n *networkHandler) ownerAnnotations() map[string]string {
+	if !n.config.GC.Enable {
+		return nil
+	}
+	return map[string]string{
+		instanceAnnotation:  instanceID(n.config),
+		heartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// startHeartbeat periodically records on the pod that the connection is still alive. It stops when the monitor is
+// cancelled.
+func (n *networkHandler) startHeartbeat(ctx context.Context) {
+	if !n.config.GC.Enable {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(n.config.GC.HeartbeatInterval):
+			}
+			if err := n.sendHeartbeat(ctx); err != nil && ctx.Err() == nil {
+				n.logger.Warningf("failed to send heartbeat to pod (%v)", err)
+			}
+		}
+	}()
+}
+
+func (n *networkHandler) sendHeartbeat(ctx context.Context) error {
+	pod := n.currentPod()
+	annotations := map[string]string{
+		heartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+	}
+	if !n.config.Workspace.Enable {
+		annotations[instanceAnnotation] = instanceID(n.config)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = n.cli.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, meta.PatchOptions{})
+	return err
+}
+
+// GarbageCollector removes pods that were left behind by ContainerSSH instances that stopped without cleaning up.
+type GarbageCollector interface {
+	// Run takes part in the leader election and collects orphaned pods while this instance is the leader. It returns
+	// when the context is cancelled.
+	Run(ctx context.Context)
+}
+
+// NewGarbageCollector creates a garbage collector for the namespace of the pod configuration. Only one replica
+// collects at a time, elected using the Lease configured in GCConfig.
+func NewGarbageCollector(config Config, logger log.Logger) (GarbageCollector, error) {
+	if !config.GC.Enable {
+		return nil, fmt.Errorf("the garbage collector requires GC.Enable to be set so pods carry heartbeats")
+	}
+	connectionConfig := CreateConnectionConfig(config)
+	cli, err := kubernetes.NewForConfig(&connectionConfig)
+	if err != nil {
+		return nil, err
+	}
+	g := &garbageCollector{
+		config:   config,
+		cli:      cli,
+		logger:   logger,
+		instance: instanceID(config),
+	}
+	leaseNamespace := config.GC.LeaseNamespace
+	if leaseNamespace == "" {
+		leaseNamespace = config.Pod.Namespace
+	}
+	g.elector, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: meta.ObjectMeta{
+				Name:      config.GC.LeaseName,
+				Namespace: leaseNamespace,
+			},
+			Client: cli.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: g.instance,
+			},
+		},
+		ReleaseOnCancel: true,
+		LeaseDuration:   config.GC.LeaseDuration,
+		RenewDeadline:   config.GC.LeaseRenewDeadline,
+		RetryPeriod:     config.GC.LeaseRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: g.collectWhileLeading,
+			OnStoppedLeading: func() {
+				logger.Debugf("garbage collector lost leadership")
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid leader election configuration (%w)", err)
+	}
+	return g, nil
+}
+
+type garbageCollector struct {
+	config   Config
+	cli      kubernetes.Interface
+	logger   log.Logger
+	instance string
+	elector  *leaderelection.LeaderElector
+}
+
+func (g *garbageCollector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		g.elector.Run(ctx)
+	}
+}
+
+// collectWhileLeading runs the collection periodically until the leadership is lost.
+func (g *garbageCollector) collectWhileLeading(ctx context.Context) {
+	g.logger.Debugf("garbage collector is now the leader")
+	for {
+		if err := g.collect(ctx); err != nil && ctx.Err() == nil {
+			g.logger.Warningf("failed to collect orphaned pods (%v)", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(g.config.GC.Interval):
+		}
+	}
+}
+
+// collect removes orphaned connection pods, expired retained pods, abandoned workspace pods and unmaintained pool pods.
+func (g *garbageCollector) collect(ctx context.Context) error {
+	if err := reapRetainedPods(ctx, g.cli, g.config.Pod.Namespace, g.logger); err != nil && ctx.Err() == nil {
+		g.logger.Warningf("failed to collect expired retained pods (%v)", err)
+	}
+
+	podList, err := g.cli.CoreV1().Pods(g.config.Pod.Namespace).List(ctx, meta.ListOptions{
+		LabelSelector: "containerssh_connection_id",
+	})
+	if err != nil {
+		return err
+	}
+	for i := range podList.Items {
+		g.collectPod(ctx, &podList.Items[i])
+	}
+
+	workspaceList, err := g.cli.CoreV1().Pods(g.config.Pod.Namespace).List(ctx, meta.ListOptions{
+		LabelSelector: workspaceLabel,
+	})
+	if err != nil {
+		return err
+	}
+	for i := range workspaceList.Items {
+		g.collectWorkspace(ctx, &workspaceList.Items[i])
+	}
+
+	poolList, err := g.cli.CoreV1().Pods(g.config.Pod.Namespace).List(ctx, meta.ListOptions{
+		LabelSelector: poolStateLabel + "=" + poolStateAvailable,
+	})
+	if err != nil {
+		return err
+	}
+	for i := range poolList.Items {
+		g.collectPoolPod(ctx, &poolList.Items[i])
+	}
+	return nil
+}
+
+// collectPoolPod removes an unassigned warm pool pod if no replica has refreshed its heartbeat within the heartbeat
+// timeout, e.g. because the pool was stopped or the profile was removed.
+func (g *garbageCollector) collectPoolPod(ctx context.Context, pod *core.Pod) {
+	if pod.DeletionTimestamp != nil {
+		return
+	}
+	lastSeen := pod.CreationTimestamp.Time
+	if heartbeat, err := time.Parse(time.RFC3339, pod.Annotations[heartbeatAnnotation]); err == nil {
+		lastSeen = heartbeat
+	}
+	if time.Since(lastSeen) < g.config.GC.HeartbeatTimeout {
+		return
+	}
+	err := g.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{UID: &pod.UID, ResourceVersion: &pod.ResourceVersion},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		g.logger.Warningf("failed to remove unmaintained pool pod %s (%v)", pod.Name, err)
+		return
+	}
+	g.logger.Noticef("removed unmaintained pool pod %s (no heartbeat since %s)", pod.Name, lastSeen.Format(time.RFC3339))
+}
+
+// orphanReason returns why a connection pod is considered orphaned, or an empty string if it is still in use. Pods
+// without the owner annotations, e.g. created by an earlier version or with GC disabled, are never orphans.
+func (g *garbageCollector) orphanReason(pod *core.Pod) string {
+	if pod.DeletionTimestamp != nil || pod.Labels[retainedLabel] == "true" {
+		return ""
+	}
+	if pod.Annotations[instanceAnnotation] == "" {
+		return ""
+	}
+	lastSeen, err := time.Parse(time.RFC3339, pod.Annotations[heartbeatAnnotation])
+	if err != nil {
+		return ""
+	}
+	if time.Since(lastSeen) > g.config.GC.HeartbeatTimeout {
+		return fmt.Sprintf("no heartbeat since %s", lastSeen.Format(time.RFC3339))
+	}
+	if pod.Annotations[instanceAnnotation] == g.instance &&
+		!isConnectionActive(pod.Labels["containerssh_connection_id"]) &&
+		time.Since(pod.CreationTimestamp.Time) > g.config.GC.HeartbeatInterval {
+		return "the connection is not known to the owning instance"
+	}
+	return ""
+}
+
+func (g *garbageCollector) collectPod(ctx context.Context, pod *core.Pod) {
+	reason := g.orphanReason(pod)
+	if reason == "" {
+		return
+	}
+	uid := pod.UID
+	err := g.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{UID: &uid},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		g.logger.Warningf("failed to remove orphaned pod %s (%v)", pod.Name, err)
+		return
+	}
+	g.logger.Noticef("removed orphaned pod %s (%s)", pod.Name, reason)
+}
+
+// collectWorkspace removes workspace pods that have been idle for longer than the idle TTL, including pods whose
+// connections stopped sending heartbeats without detaching.
+func (g *garbageCollector) collectWorkspace(ctx context.Context, pod *core.Pod) {
+	if pod.DeletionTimestamp != nil {
+		return
+	}
+	if workspaceConnections(pod) == 0 {
+		if err := removeIdleWorkspace(ctx, g.cli, pod, g.config.Workspace.IdleTTL); err != nil {
+			g.logger.Warningf("failed to remove idle workspace pod %s (%v)", pod.Name, err)
+		}
+		return
+	}
+	heartbeat, err := time.Parse(time.RFC3339, pod.Annotations[heartbeatAnnotation])
+	if err != nil || time.Since(heartbeat) < g.config.GC.HeartbeatTimeout+g.config.Workspace.IdleTTL {
+		return
+	}
+	err = g.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{UID: &pod.UID, ResourceVersion: &pod.ResourceVersion},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		g.logger.Warningf("failed to remove abandoned workspace pod %s (%v)", pod.Name, err)
+		return
+	}
+	g.logger.Noticef("removed abandoned workspace pod %s (no heartbeat since %s)", pod.Name, heartbeat.Format(time.RFC3339))
+}
@@ -0,0 +1,101 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func TestOrphanReason(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.GC.Enable = true
+	config.GC.InstanceID = "containerssh-0"
+	g := &garbageCollector{config: config, instance: config.GC.InstanceID}
+
+	newPod := func(instance string, connectionID string, heartbeat time.Time) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				CreationTimestamp: meta.NewTime(time.Now().Add(-time.Hour)),
+				Labels:            map[string]string{"containerssh_connection_id": connectionID},
+				Annotations: map[string]string{
+					instanceAnnotation:  instance,
+					heartbeatAnnotation: heartbeat.UTC().Format(time.RFC3339),
+				},
+			},
+		}
+	}
+
+	registerConnection("active")
+	defer unregisterConnection("active")
+
+	assert.Equal(t, "", g.orphanReason(newPod("containerssh-0", "active", time.Now())))
+	assert.Equal(t, "", g.orphanReason(newPod("containerssh-1", "unknown", time.Now())))
+	assert.NotEqual(t, "", g.orphanReason(newPod("containerssh-0", "unknown", time.Now())))
+	assert.NotEqual(t, "", g.orphanReason(newPod("containerssh-1", "unknown", time.Now().Add(-time.Hour))))
+
+	unannotated := newPod("containerssh-0", "unknown", time.Now())
+	unannotated.Annotations = nil
+	assert.Equal(t, "", g.orphanReason(unannotated))
+
+	noHeartbeat := newPod("containerssh-1", "unknown", time.Now())
+	delete(noHeartbeat.Annotations, heartbeatAnnotation)
+	assert.Equal(t, "", g.orphanReason(noHeartbeat))
+
+	retained := newPod("containerssh-1", "unknown", time.Now().Add(-time.Hour))
+	retained.Labels[retainedLabel] = "true"
+	assert.Equal(t, "", g.orphanReason(retained))
+}
+
+func TestFailedRetainedPodReapShouldNotStopCollection(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.GC.Enable = true
+	config.GC.InstanceID = "containerssh-0"
+
+	cli := fake.NewSimpleClientset(&core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:              "orphan",
+			Namespace:         config.Pod.Namespace,
+			CreationTimestamp: meta.NewTime(time.Now().Add(-time.Hour)),
+			Labels:            map[string]string{"containerssh_connection_id": "unknown"},
+			Annotations: map[string]string{
+				instanceAnnotation:  "containerssh-1",
+				heartbeatAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	cli.PrependReactor("list", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		selector := action.(k8sTesting.ListAction).GetListRestrictions().Labels.String()
+		if strings.Contains(selector, retainedLabel) {
+			return true, nil, fmt.Errorf("list failed")
+		}
+		return false, nil, nil
+	})
+	g := &garbageCollector{config: config, cli: cli, instance: config.GC.InstanceID, logger: newTestNetworkHandler(t).logger}
+
+	assert.NoError(t, g.collect(context.Background()))
+	pods, err := cli.CoreV1().Pods(config.Pod.Namespace).List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, pods.Items)
+}
+
+func TestInvalidLeaseConfigShouldFailGarbageCollector(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.GC.Enable = true
+	config.GC.LeaseRenewDeadline = config.GC.LeaseDuration
+
+	_, err := NewGarbageCollector(config, newTestNetworkHandler(t).logger)
+	assert.Error(t, err)
+}
@@ -7,7 +7,9 @@ require (
 	github.com/containerssh/sshserver v0.9.14
 	github.com/containerssh/structutils v0.9.0
 	github.com/containerssh/unixutils v0.9.0
+	github.com/mattn/go-shellwords v1.0.10
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9
 	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/api v0.20.0
 	k8s.io/apimachinery v0.20.0
@@ -2,6 +2,7 @@ package kuberun
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -14,7 +15,28 @@ import (
 	restclient "k8s.io/client-go/rest"
 )
 
-func New(client net.TCPAddr, connectionID string, config Config, logger log.Logger) (sshserver.NetworkConnectionHandler, error) {
+// NetworkConnectionHandler is the network connection handler returned by New. In addition to the sshserver interface
+// it stops the programs of the connection when the server shuts down.
+type NetworkConnectionHandler interface {
+	sshserver.NetworkConnectionHandler
+
+	// OnShutdown stops the programs of all sessions and waits for them until the shutdown context expires. The pod is
+	// removed in OnDisconnect when the server closes the connection.
+	OnShutdown(shutdownContext context.Context)
+}
+
+// New creates a network connection handler that runs the sessions of the connection in a Kubernetes pod. The optional
+// hooks are notified about the lifecycle of the pod and the sessions.
+func New(
+	client net.TCPAddr,
+	connectionID string,
+	config Config,
+	logger log.Logger,
+	hooks ...LifecycleHooks,
+) (NetworkConnectionHandler, error) {
+	if config.Workspace.Enable && !config.GC.Enable {
+		return nil, fmt.Errorf("workspaces require GC.Enable to be set so idle workspace pods are removed")
+	}
 	connectionConfig := CreateConnectionConfig(config)
 
 	cli, err := kubernetes.NewForConfig(&connectionConfig)
@@ -27,21 +49,28 @@ func New(client net.TCPAddr, connectionID string, config Config, logger log.Logg
 		return nil, err
 	}
 
-	return &networkHandler{
-		restClientConfig: connectionConfig,
-		mutex:            &sync.Mutex{},
-		client:           client,
-		connectionID:     connectionID,
-		config:           config,
-		onDisconnect:     map[uint64]func(){},
-		onShutdown:       map[uint64]func(shutdownContext context.Context){},
-		cli:              cli,
-		restClient:       restClient,
-		pod:              nil,
-		cancelStart:      nil,
-		labels:           nil,
-		logger:           logger,
-	}, nil
+	connectionContext, cancelConnection := context.WithCancel(context.Background())
+	n := &networkHandler{
+		connectionContext: connectionContext,
+		cancelConnection:  cancelConnection,
+		restClientConfig:  connectionConfig,
+		mutex:             &sync.Mutex{},
+		client:            client,
+		connectionID:      connectionID,
+		config:            config,
+		onDisconnect:      map[uint64]func(){},
+		onShutdown:        map[uint64]func(shutdownContext context.Context){},
+		cli:               cli,
+		restClient:        restClient,
+		pod:               nil,
+		cancelStart:       nil,
+		labels:            nil,
+		logger:            logger,
+		channels:          map[uint64]*channelHandler{},
+		hooks:             hooks,
+	}
+	n.startEventRecorder()
+	return n, nil
 }
 
 // CreateConnectionConfig creates a Kubernetes REST client config from the kuberun config structure.
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	goLog "log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,26 +21,65 @@ import (
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/remotecommand"
 	watchTools "k8s.io/client-go/tools/watch"
 )
 
 type networkHandler struct {
+	// lastActivityTime is the time of the last session traffic in Unix nanoseconds. It is accessed atomically and
+	// kept first for 64-bit alignment.
+	lastActivityTime int64
+
 	mutex        *sync.Mutex
 	client       net.TCPAddr
 	connectionID string
 	config       Config
 
+	// connectionContext is cancelled when the connection drops or the server shuts down, which stops all programs.
+	connectionContext context.Context
+	cancelConnection  func()
+
 	// onDisconnect contains a per-channel disconnect handler
 	onDisconnect map[uint64]func()
 	onShutdown   map[uint64]func(shutdownContext context.Context)
 
-	cli              *kubernetes.Clientset
+	cli              kubernetes.Interface
 	restClient       *restclient.RESTClient
 	pod              *core.Pod
 	cancelStart      func()
 	labels           map[string]string
+	ownerReferences  []meta.OwnerReference
+	username         string
 	logger           log.Logger
 	restClientConfig restclient.Config
+	// executorFactory replaces the SPDY executor running commands in the pod if set.
+	executorFactory  func(pod *core.Pod, options *core.PodExecOptions) (remotecommand.Executor, error)
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+	hooks            lifecycleHooks
+	// oneShotConsumed is true if the output of the one-shot pod has already been sent to a session.
+	oneShotConsumed bool
+	// channels contains the session channels that are currently running a program.
+	channels map[uint64]*channelHandler
+	// closed contains the reason why the connection no longer runs sessions, e.g. because the pod went away.
+	closed        error
+	cancelMonitor func()
+	// ready is closed when the pod creation has finished, successfully or not. It is nil until the creation starts.
+	ready        chan struct{}
+	startError   error
+	disconnected bool
+	// loginShellPath caches the login shell of the container user read from /etc/passwd.
+	loginShellPath string
+	// autoShellPath is the shell detected in the console container, and autoShellError the reason if none was found.
+	autoShellPath  string
+	autoShellError error
+	// mappedUser is the Unix user the programs run as, or nil if the user is not mapped. It is set before the pod is
+	// ready and not changed afterwards.
+	mappedUser *MappedUser
+	// lastExitStatus is the exit status of the session that exited last, if sessionExited is true.
+	lastExitStatus sshserver.ExitStatus
+	sessionExited  bool
 }
 
 func (n *networkHandler) OnAuthPassword(_ string, _ []byte) (response sshserver.AuthResponse, reason error) {
@@ -53,7 +93,8 @@ func (n *networkHandler) OnAuthPubKey(_ string, _ string) (response sshserver.Au
 func (n *networkHandler) OnHandshakeFailed(_ error) {
 }
 
-// isPodAvailableEvent returns true if the event signals that the pod is either running or has already finished running.
+// isPodAvailableEvent returns true if the event signals that the pod is running and ready. A pod that has already
+// finished, or whose console container has terminated, is reported as an error unless the one-shot mode is enabled.
 func (n *networkHandler) isPodAvailableEvent(event watch.Event) (bool, error) {
 	if event.Type == watch.Deleted {
 		return false, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, "")
@@ -61,41 +102,128 @@ func (n *networkHandler) isPodAvailableEvent(event watch.Event) (bool, error) {
 
 	switch eventObject := event.Object.(type) {
 	case *core.Pod:
+		if n.config.Pod.OneShot {
+			switch eventObject.Status.Phase {
+			case core.PodFailed, core.PodSucceeded, core.PodRunning:
+				return true, nil
+			}
+			return false, nil
+		}
+		if err := n.checkConsoleContainer(eventObject); err != nil {
+			return false, err
+		}
 		switch eventObject.Status.Phase {
 		case core.PodFailed, core.PodSucceeded:
-			return true, nil
+			return false, fmt.Errorf(
+				"pod %s finished before the session started (phase %s)",
+				eventObject.Name,
+				eventObject.Status.Phase,
+			)
 		case core.PodRunning:
-			conditions := eventObject.Status.Conditions
-			for _, condition := range conditions {
-				if condition.Type == core.PodReady &&
-					condition.Status == core.ConditionTrue {
-					return true, nil
-				}
-			}
+			return isPodReady(eventObject), nil
 		}
 	}
 	return false, nil
 }
 
-//This function waits for a pod to be either running or already complete.
+// isPodReady returns true if the pod is running and has the ready condition.
+func isPodReady(pod *core.Pod) bool {
+	if pod.Status.Phase != core.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodReady &&
+			condition.Status == core.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// consoleContainerStatus returns the status of the console container from the pod, or nil if it is not yet reported.
+func (n *networkHandler) consoleContainerStatus(pod *core.Pod) *core.ContainerStatus {
+	name := n.config.Pod.Spec.Containers[n.config.Pod.ConsoleContainerNumber].Name
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == name {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+// checkConsoleContainer returns an error if the console container has terminated, or is waiting to be restarted
+// after terminating.
+func (n *networkHandler) checkConsoleContainer(pod *core.Pod) error {
+	status := n.consoleContainerStatus(pod)
+	if status == nil {
+		return nil
+	}
+	terminated := status.State.Terminated
+	if terminated == nil && status.State.Waiting != nil {
+		terminated = status.LastTerminationState.Terminated
+	}
+	if terminated != nil {
+		return fmt.Errorf(
+			"console container %s terminated before the session started (%s)",
+			status.Name,
+			describeTermination(terminated),
+		)
+	}
+	return nil
+}
+
+// describeTermination formats the exit code, reason and message of a terminated container for the user and the logs.
+func describeTermination(terminated *core.ContainerStateTerminated) string {
+	description := fmt.Sprintf("exit code %d", terminated.ExitCode)
+	if terminated.Signal != 0 {
+		description += fmt.Sprintf(", signal %d", terminated.Signal)
+	}
+	if terminated.Reason != "" {
+		description += fmt.Sprintf(", reason %s", terminated.Reason)
+	}
+	if message := strings.TrimSpace(terminated.Message); message != "" {
+		description += fmt.Sprintf(": %s", message)
+	}
+	return description
+}
+
+// This function waits for a pod to be either running or already complete.
 func (n *networkHandler) waitForPodAvailable(ctx context.Context) (err error) {
+	return n.waitForPodCondition(ctx, n.isPodAvailableEvent)
+}
 
+// isConsoleContainerTerminatedEvent returns true if the console container of the pod has terminated.
+func (n *networkHandler) isConsoleContainerTerminatedEvent(event watch.Event) (bool, error) {
+	if event.Type == watch.Deleted {
+		return false, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, "")
+	}
+	if pod, ok := event.Object.(*core.Pod); ok {
+		if status := n.consoleContainerStatus(pod); status != nil && status.State.Terminated != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitForPodCondition waits until the condition returns true for the pod and stores the last seen state of the pod.
+func (n *networkHandler) waitForPodCondition(ctx context.Context, condition watchTools.ConditionFunc) (err error) {
+	pod := n.currentPod()
 	fieldSelector := fields.
-		OneTermEqualSelector("metadata.name", n.pod.Name).
+		OneTermEqualSelector("metadata.name", pod.Name).
 		String()
 	listWatch := &cache.ListWatch{
 		ListFunc: func(options meta.ListOptions) (runtime.Object, error) {
 			options.FieldSelector = fieldSelector
 			return n.cli.
 				CoreV1().
-				Pods(n.pod.Namespace).
+				Pods(pod.Namespace).
 				List(ctx, options)
 		},
 		WatchFunc: func(options meta.ListOptions) (watch.Interface, error) {
 			options.FieldSelector = fieldSelector
 			return n.cli.
 				CoreV1().
-				Pods(n.pod.Namespace).
+				Pods(pod.Namespace).
 				Watch(ctx, options)
 		},
 	}
@@ -105,28 +233,108 @@ func (n *networkHandler) waitForPodAvailable(ctx context.Context) (err error) {
 		listWatch,
 		&core.Pod{},
 		nil,
-		n.isPodAvailableEvent,
+		condition,
 	)
 	if event != nil {
+		n.mutex.Lock()
 		n.pod = event.Object.(*core.Pod)
+		n.mutex.Unlock()
 	}
 	return err
 }
 
 func (n *networkHandler) OnHandshakeSuccess(username string) (connection sshserver.SSHConnectionHandler, failureReason error) {
 	n.mutex.Lock()
-	if n.pod != nil {
+	if n.labels != nil {
 		n.mutex.Unlock()
 		return nil, fmt.Errorf("handshake already complete")
 	}
+	n.username = username
+	registerConnection(n.connectionID)
+	n.labels = map[string]string{
+		"containerssh_connection_id": n.connectionID,
+		"containerssh_ip":            n.client.IP.String(),
+		"containerssh_username":      username,
+	}
+	n.mutex.Unlock()
+
+	sshConnection := &sshConnectionHandler{
+		networkHandler: n,
+		username:       username,
+		mutex:          &sync.Mutex{},
+	}
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeout)
+	switch n.config.StartMode {
+	case StartModeSession:
+		return sshConnection, nil
+	case StartModeBackground:
+		n.startPodInBackground()
+		return sshConnection, nil
+	default:
+		n.startPodInBackground()
+		if err := n.waitForPodStart(); err != nil {
+			return nil, err
+		}
+		return sshConnection, nil
+	}
+}
+
+// startPodInBackground starts creating the pod unless it is already being created or the client has disconnected.
+// The ready channel is closed once the pod is available or the creation failed.
+func (n *networkHandler) startPodInBackground() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.ready != nil || n.disconnected {
+		return
+	}
+	n.ready = make(chan struct{})
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), n.startTimeout())
 	n.cancelStart = cancelFunc
-	defer func() {
+
+	go func() {
+		err := n.startPod(ctx)
+		cancelFunc()
+
+		n.mutex.Lock()
 		n.cancelStart = nil
+		n.startError = err
+		pod := n.pod
+		disconnected := n.disconnected
 		n.mutex.Unlock()
+		if err != nil && pod != nil && !disconnected {
+			n.hooks.OnPodFailed(pod, err)
+		}
+		close(n.ready)
 	}()
+}
 
+// startTimeout returns how long the pod creation may take, including the init commands, which have their own timeouts.
+func (n *networkHandler) startTimeout() time.Duration {
+	timeout := n.config.Timeout
+	for _, command := range n.config.Pod.InitCommands {
+		timeout += n.podCommandTimeout(command)
+	}
+	return timeout
+}
+
+// waitForPodStart waits for the pod creation started by startPodInBackground and returns its result.
+func (n *networkHandler) waitForPodStart() error {
+	n.mutex.Lock()
+	ready := n.ready
+	n.mutex.Unlock()
+	if ready == nil {
+		return fmt.Errorf("the pod has not been started")
+	}
+	<-ready
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.startError
+}
+
+// startPod creates the pod, waits for it to become available and starts monitoring it.
+func (n *networkHandler) startPod(ctx context.Context) error {
 	goLogger := log.NewGoLogWriter(n.logger)
 	oldFlags := goLog.Flags()
 	oldOutput := goLog.Writer()
@@ -141,33 +349,116 @@ func (n *networkHandler) OnHandshakeSuccess(username string) (connection sshserv
 		goLog.SetPrefix(oldPrefix)
 	}()
 
-	spec := n.config.Pod.Spec
+	if n.config.Delete.Wait && !n.config.Workspace.Enable {
+		if err := n.waitForPendingDeletions(ctx); err != nil {
+			return err
+		}
+	}
 
-	spec.Containers[n.config.Pod.ConsoleContainerNumber].Command = n.config.Pod.IdleCommand
-	n.labels = map[string]string{
-		"containerssh_connection_id": n.connectionID,
-		"containerssh_ip":            n.client.IP.String(),
-		"containerssh_username":      username,
+	if err := n.mapUserBeforeCreate(); err != nil {
+		return err
 	}
 
-	var err error
-	n.pod, err = n.createPod(ctx, spec)
+	ownerReferences, err := n.resolveOwnerReferences(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	n.ownerReferences = ownerReferences
 
+	var pod *core.Pod
+	if n.config.Workspace.Enable {
+		pod, err = n.attachWorkspace(ctx)
+	} else {
+		pod, err = n.claimOrCreatePod(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	n.pod = pod
 	n.mutex.Unlock()
-	err = n.waitForPodAvailable(ctx)
+	if err := n.hooks.OnPodCreated(pod); err != nil {
+		return fmt.Errorf("pod created hook failed (%w)", err)
+	}
+
+	if err := n.waitForPodAvailable(ctx); err != nil {
+		return err
+	}
+	if err := n.mapUserAfterReady(ctx); err != nil {
+		return err
+	}
+	if err := n.runInitCommands(ctx); err != nil {
+		return err
+	}
+	n.probeShell(ctx)
+	if err := n.hooks.OnPodReady(n.currentPod()); err != nil {
+		return fmt.Errorf("pod ready hook failed (%w)", err)
+	}
+	n.recordEvent(
+		core.EventTypeNormal,
+		eventReasonConnected,
+		"User %s connected from %s (connection %s)",
+		n.username,
+		n.client.IP.String(),
+		n.connectionID,
+	)
+
 	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.disconnected {
+		return fmt.Errorf("client disconnected")
+	}
+	n.startPodMonitor()
+	return nil
+}
+
+// createPodSpec returns the pod spec to launch for the configuration.
+func createPodSpec(config Config) *core.PodSpec {
+	spec := config.Pod.Spec.DeepCopy()
+
+	if config.Pod.OneShot {
+		// The command must run exactly once, so the kubelet must not restart it when it exits.
+		spec.RestartPolicy = core.RestartPolicyNever
+	} else {
+		spec.Containers[config.Pod.ConsoleContainerNumber].Command = config.Pod.IdleCommand
+	}
+	addMetadataVolume(config, spec)
+	return spec
+}
+
+// claimOrCreatePod takes a ready pod from the warm pool if the pool is enabled and not empty, and creates a new pod
+// otherwise. Pool pods are created before the connection, so the variables describing the connection are not in their
+// container environment and can only be passed to programs with the env command. The pool is not used if the env
+// command is disabled.
+func (n *networkHandler) claimOrCreatePod(ctx context.Context) (*core.Pod, error) {
+	if n.config.Pool.Size > 0 && !n.config.Pod.OneShot && !n.runsAsMappedUser() && n.config.Pod.EnvCommand != "" {
+		pod, err := n.claimPooledPod(ctx)
+		if err != nil {
+			n.logger.Warningf("failed to claim pod from warm pool, creating a new pod (%v)", err)
+		} else if pod != nil {
+			n.logger.Debugf("claimed pod %s from warm pool", pod.Name)
+			return pod, nil
+		} else {
+			n.logger.Debugf("warm pool is empty, creating a new pod")
+		}
+	}
+	spec := createPodSpec(n.config)
+	spec.ActiveDeadlineSeconds = activeDeadlineSeconds(n.config, nil)
+	n.addConnectionEnv(spec, false)
+	n.applyUserMappingToSpec(spec)
+	return n.createPod(ctx, *spec)
+}
+
+func (n *networkHandler) claimPooledPod(ctx context.Context) (*core.Pod, error) {
+	key, err := poolKey(n.config)
 	if err != nil {
 		return nil, err
 	}
-
-	return &sshConnectionHandler{
-		networkHandler: n,
-		username:       username,
-		mutex:          &sync.Mutex{},
-	}, nil
+	return claimPoolPod(ctx, n.cli, n.config, key, meta.ObjectMeta{
+		Labels:          n.labels,
+		Annotations:     n.ownerAnnotations(),
+		OwnerReferences: n.ownerReferences,
+	})
 }
 
 func (n *networkHandler) createPod(ctx context.Context, spec core.PodSpec) (pod *core.Pod, err error) {
@@ -176,9 +467,11 @@ func (n *networkHandler) createPod(ctx context.Context, spec core.PodSpec) (pod
 			ctx,
 			&core.Pod{
 				ObjectMeta: meta.ObjectMeta{
-					GenerateName: "containerssh-",
-					Namespace:    n.config.Pod.Namespace,
-					Labels:       n.labels,
+					GenerateName:    "containerssh-",
+					Namespace:       n.config.Pod.Namespace,
+					Labels:          n.labels,
+					Annotations:     n.ownerAnnotations(),
+					OwnerReferences: n.ownerReferences,
 				},
 				Spec: spec,
 			},
@@ -200,47 +493,70 @@ func (n *networkHandler) createPod(ctx context.Context, spec core.PodSpec) (pod
 }
 
 func (n *networkHandler) OnDisconnect() {
+	defer unregisterConnection(n.connectionID)
+	defer n.stopEventRecorder()
+
 	n.mutex.Lock()
+	n.disconnected = true
+	if n.cancelMonitor != nil {
+		n.cancelMonitor()
+		n.cancelMonitor = nil
+	}
+	if n.cancelStart != nil {
+		n.cancelStart()
+	}
+	ready := n.ready
+	n.mutex.Unlock()
+	n.cancelConnection()
 
-	shutdownContext, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeout)
+	if ready == nil {
+		return
+	}
+	<-ready
 
-	success := true
-	var lastError error
-	for {
-		lastError = nil
-		if n.pod != nil {
-			if n.cancelStart != nil {
-				n.cancelStart()
-				n.cancelStart = nil
-			}
-			success = false
-			request := n.restClient.
-				Delete().
-				Namespace(n.pod.Namespace).
-				Resource("pods").
-				Name(n.pod.Name).
-				Body(&meta.DeleteOptions{})
-			result := request.Do(shutdownContext)
-			if result.Error() != nil {
-				lastError = result.Error()
-				n.logger.Warningf("failed to remove pod, retrying in 10 seconds (%v)", lastError)
-				n.mutex.Unlock()
-				select {
-				case <-shutdownContext.Done():
-					break
-				default:
-					time.Sleep(10 * time.Second)
-					n.mutex.Lock()
-				}
-			} else {
-				success = true
-				n.mutex.Unlock()
-				break
-			}
-		}
+	n.recordEvent(core.EventTypeNormal, eventReasonDisconnected, "User %s disconnected (%s)", n.username, n.disconnectReason())
+	n.drainChannels()
+	n.runLogoutCommands()
+
+	n.mutex.Lock()
+	pod := n.pod
+	n.mutex.Unlock()
+
+	shutdownContext, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeout)
+	defer cancelFunc()
+	if pod == nil {
+		n.removeSessionConfigMap(shutdownContext, false)
+		return
 	}
-	if !success {
-		n.logger.Errorf("failed to remove pod, giving up (%v)", lastError)
+	if n.config.Workspace.Enable {
+		n.detachWorkspace(shutdownContext, pod)
+		return
 	}
-	cancelFunc()
+	if n.retainPodIfRequired(shutdownContext, pod) {
+		n.removeSessionConfigMap(shutdownContext, true)
+		return
+	}
+	n.hooks.OnPodDeleted(pod, n.removePod(shutdownContext, pod))
+	n.removeSessionConfigMap(shutdownContext, false)
+}
+
+// disconnectReason returns why the connection ended for the logs and events.
+func (n *networkHandler) disconnectReason() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch {
+	case n.startError != nil:
+		return fmt.Sprintf("the pod failed to start: %v", n.startError)
+	case n.closed != nil:
+		return n.closed.Error()
+	default:
+		return "the client closed the connection"
+	}
+}
+
+// currentPod returns the last known state of the pod.
+func (n *networkHandler) currentPod() *core.Pod {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.pod
 }
@@ -0,0 +1,163 @@
+package kuberun
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func newTestNetworkHandler(t *testing.T) *networkHandler {
+	config := Config{}
+	structutils.Defaults(&config)
+	logger, err := log.New(
+		log.Config{
+			Level:  log.LevelDebug,
+			Format: log.FormatText,
+		},
+		"kuberun",
+		os.Stdout,
+	)
+	assert.NoError(t, err)
+	connectionContext, cancelConnection := context.WithCancel(context.Background())
+	t.Cleanup(cancelConnection)
+	return &networkHandler{
+		mutex:             &sync.Mutex{},
+		config:            config,
+		logger:            logger,
+		channels:          map[uint64]*channelHandler{},
+		connectionContext: connectionContext,
+		cancelConnection:  cancelConnection,
+		onDisconnect:      map[uint64]func(){},
+		onShutdown:        map[uint64]func(shutdownContext context.Context){},
+	}
+}
+
+func TestTerminatedConsoleContainerShouldFailStartup(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase: core.PodRunning,
+			ContainerStatuses: []core.ContainerStatus{
+				{
+					Name: "shell",
+					State: core.ContainerState{
+						Terminated: &core.ContainerStateTerminated{
+							ExitCode: 3,
+							Reason:   "Error",
+							Message:  "idle command not found",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	available, err := n.isPodAvailableEvent(watch.Event{Type: watch.Modified, Object: pod})
+	assert.False(t, available)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exit code 3")
+	assert.Contains(t, err.Error(), "idle command not found")
+}
+
+func TestFinishedPodShouldFailStartup(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase: core.PodSucceeded,
+		},
+	}
+
+	available, err := n.isPodAvailableEvent(watch.Event{Type: watch.Modified, Object: pod})
+	assert.False(t, available)
+	assert.Error(t, err)
+}
+
+func TestFinishedPodShouldBeAvailableInOneShotMode(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.OneShot = true
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase: core.PodSucceeded,
+		},
+	}
+
+	available, err := n.isPodAvailableEvent(watch.Event{Type: watch.Modified, Object: pod})
+	assert.True(t, available)
+	assert.NoError(t, err)
+}
+
+func TestStartTimeoutShouldIncludeInitCommands(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Timeout = time.Minute
+	n.config.Pod.InitCommands = []PodCommand{
+		{Command: []string{"/bin/true"}, Timeout: 10 * time.Second},
+		{Command: []string{"/bin/true"}},
+	}
+
+	assert.Equal(t, 2*time.Minute+10*time.Second, n.startTimeout())
+}
+
+func TestStartPodShouldStartMonitor(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.MaxConnectionDuration = time.Hour
+	n.config.IdleTimeout = time.Hour
+	cli := fake.NewSimpleClientset()
+	cli.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod)
+		pod.Name = pod.GenerateName + "test"
+		pod.Status = core.PodStatus{
+			Phase:      core.PodRunning,
+			Conditions: []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}},
+		}
+		return false, nil, nil
+	})
+	n.cli = cli
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- n.startPod(ctx)
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("starting the pod did not finish")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	assert.NotNil(t, n.cancelMonitor)
+	assert.Equal(t, "containerssh-test", n.pod.Name)
+	n.cancelMonitor()
+}
+
+func TestOneShotPodShouldNotRestart(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.Spec.RestartPolicy = core.RestartPolicyAlways
+	assert.Equal(t, core.RestartPolicyAlways, createPodSpec(n.config).RestartPolicy)
+
+	n.config.Pod.OneShot = true
+	assert.Equal(t, core.RestartPolicyNever, createPodSpec(n.config).RestartPolicy)
+}
+
+func TestSizeQueueShouldKeepLatestSizeWithoutBlocking(t *testing.T) {
+	queue := &sizeQueue{resizeChan: make(chan remotecommand.TerminalSize, 1)}
+	queue.Push(remotecommand.TerminalSize{Width: 80, Height: 25})
+	queue.Push(remotecommand.TerminalSize{Width: 120, Height: 40})
+
+	assert.Equal(t, &remotecommand.TerminalSize{Width: 120, Height: 40}, queue.Next())
+}
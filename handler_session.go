@@ -1,17 +1,16 @@
 package kuberun
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/containerssh/sshserver"
 	"github.com/containerssh/unixutils"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/remotecommand"
-	execUtil "k8s.io/client-go/util/exec"
-	"k8s.io/kubectl/pkg/scheme"
 )
 
 type channelHandler struct {
@@ -24,6 +23,16 @@ type channelHandler struct {
 	rows              uint32
 	channelID         uint64
 	terminalSizeQueue PushSizeQueue
+	stderr            io.Writer
+	onExit            func(exitStatus sshserver.ExitStatus)
+	// workingDirectory is the working directory requested by the client, or empty to use the default.
+	workingDirectory string
+	// cancelProgram cancels the context of the running program, which stops it. It is set while the program runs.
+	cancelProgram func()
+	// sessionType is the type of the request that started the program, e.g. shell or exec.
+	sessionType string
+	// channel is the SSH channel of the session if the server passed it as stdin, used to send requests to the client.
+	channel channelRequester
 }
 
 type PushSizeQueue interface {
@@ -32,11 +41,20 @@ type PushSizeQueue interface {
 	Push(remotecommand.TerminalSize)
 }
 
+// sizeQueue holds the latest terminal size until the stream reads it. resizeChan must have a buffer of one, so
+// pushing never blocks, even before the stream has started. Sizes that were not read yet are replaced.
 type sizeQueue struct {
+	mutex      sync.Mutex
 	resizeChan chan remotecommand.TerminalSize
 }
 
 func (s *sizeQueue) Push(size remotecommand.TerminalSize) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.resizeChan:
+	default:
+	}
 	s.resizeChan <- size
 }
 
@@ -58,6 +76,19 @@ func (c *channelHandler) OnEnvRequest(_ uint64, name string, value string) error
 	if c.running {
 		return fmt.Errorf("program already running")
 	}
+	if c.networkHandler.isWorkingDirectoryEnv(name) {
+		dir, err := c.networkHandler.checkWorkingDirectory(value)
+		if err != nil {
+			c.networkHandler.logger.Infof("rejected working directory %s (%v)", value, err)
+			return err
+		}
+		c.workingDirectory = dir
+		return nil
+	}
+	if err := c.networkHandler.checkEnv(c.env, name, value); err != nil {
+		c.networkHandler.logger.Infof("rejected environment variable %s (%v)", name, err)
+		return err
+	}
 	c.env[name] = value
 	return nil
 }
@@ -83,23 +114,61 @@ func (c *channelHandler) OnPtyRequest(
 	return nil
 }
 
-func (c *channelHandler) parseProgram(program string) []string {
-	programParts, err := unixutils.ParseCMD(program)
-	if err != nil {
-		return []string{"/bin/sh", "-c", program}
-	} else {
-		if strings.HasPrefix(programParts[0], "/") || strings.HasPrefix(
+// programEnv returns the environment of the program: the variables requested by the client, including TERM, followed
+// by the variables forced by the server, the variables describing the mapped user and the variables describing the
+// connection that are missing from the pod spec, which the client cannot override.
+func (c *channelHandler) programEnv() map[string]string {
+	connectionEnv := c.networkHandler.execConnectionEnv()
+	c.sshHandler.mutex.Lock()
+	defer c.sshHandler.mutex.Unlock()
+	env := map[string]string{}
+	for name, value := range c.env {
+		env[name] = value
+	}
+	for name, value := range c.networkHandler.config.Env.Force {
+		env[name] = value
+	}
+	for name, value := range c.networkHandler.mappedUserEnv() {
+		env[name] = value
+	}
+	for name, value := range connectionEnv {
+		env[name] = value
+	}
+	return env
+}
+
+// parseProgram turns the command of an exec request into the arguments to execute according to the exec mode.
+func (c *channelHandler) parseProgram(program string) ([]string, error) {
+	n := c.networkHandler
+	switch n.config.Pod.ExecMode {
+	case ExecModeArgv:
+		return parseArgv(program)
+	case ExecModeShell:
+		shell, err := n.execShell()
+		if err != nil {
+			return nil, err
+		}
+		return []string{shell, "-c", program}, nil
+	case ExecModeLogin:
+		shell, err := n.execShell()
+		if err != nil {
+			return nil, err
+		}
+		return []string{shell, "-lc", program}, nil
+	default:
+		programParts, err := unixutils.ParseCMD(program)
+		if err == nil && len(programParts) > 0 && (strings.HasPrefix(programParts[0], "/") || strings.HasPrefix(
 			programParts[0],
 			"./",
-		) || strings.HasPrefix(programParts[0], "../") {
-			return programParts
-		} else {
-			return []string{"/bin/sh", "-c", program}
+		) || strings.HasPrefix(programParts[0], "../")) {
+			return programParts, nil
 		}
+		return []string{"/bin/sh", "-c", program}, nil
 	}
 }
 
 func (c *channelHandler) run(
+	sessionType string,
 	program []string,
 	stdin io.Reader,
 	stdout io.Writer,
@@ -109,22 +178,175 @@ func (c *channelHandler) run(
 	c.networkHandler.mutex.Lock()
 	defer c.networkHandler.mutex.Unlock()
 
-	c.running = true
+	if c.networkHandler.closed != nil {
+		return c.networkHandler.closed
+	}
 
-	container := c.networkHandler.pod.Spec.Containers[c.networkHandler.config.Pod.ConsoleContainerNumber]
+	container := c.networkHandler.config.Pod.Spec.Containers[c.networkHandler.config.Pod.ConsoleContainerNumber]
 
-	go c.streamIO(program, stdin, stdout, stderr, container, func(exitStatus sshserver.ExitStatus) {
-		c.networkHandler.mutex.Lock()
-		defer c.networkHandler.mutex.Unlock()
+	c.stderr = stderr
+	c.onExit = onExit
 
-		c.running = false
-		onExit(exitStatus)
-	})
+	oneShot := c.networkHandler.config.Pod.OneShot
+	if oneShot {
+		if c.networkHandler.oneShotConsumed {
+			return fmt.Errorf("the output of the one-shot pod has already been sent to another session")
+		}
+		c.networkHandler.oneShotConsumed = true
+	}
+
+	c.networkHandler.hooks.OnSessionStart(c.channelID, program)
+	c.start()
+	ctx, cancel := context.WithCancel(c.networkHandler.connectionContext)
+	c.cancelProgram = cancel
+	drained := c.registerChannelStop()
+	c.sessionType = sessionType
+	if channel, ok := stdin.(channelRequester); ok {
+		c.channel = channel
+		stdin = &eofWatchingReader{reader: stdin, onEOF: func() {
+			go c.watchChannelClose(ctx, channel, cancel)
+		}}
+	}
+	stdin = &activityReader{reader: stdin, networkHandler: c.networkHandler}
+	stdout = &activityWriter{writer: &errorCancelingWriter{writer: stdout, cancel: cancel}, networkHandler: c.networkHandler}
+	stderr = &errorCancelingWriter{writer: stderr, cancel: cancel}
+
+	go func() {
+		defer drained()
+		defer cancel()
+		if err := c.networkHandler.waitForPodStart(); err != nil {
+			c.abort(
+				fmt.Sprintf("failed to start the pod for this connection: %v", err),
+				c.networkHandler.config.ExitStatus.SetupFailure,
+			)
+			return
+		}
+		c.networkHandler.recordEvent(
+			corev1.EventTypeNormal,
+			eventReasonSessionStarted,
+			"Session %d started %s %v",
+			c.channelID,
+			sessionType,
+			program,
+		)
+		if oneShot {
+			c.streamLogs(ctx, stdout, container, c.exit)
+		} else {
+			c.streamIO(ctx, program, stdin, stdout, stderr, container, c.exit)
+		}
+	}()
 
 	return nil
 }
 
+// fail accepts the request, but instead of running a program it writes the message to stderr and closes the session
+// with the setup failure exit status.
+func (c *channelHandler) fail(
+	message string,
+	stderr io.Writer,
+	onExit func(exitStatus sshserver.ExitStatus),
+) error {
+	c.networkHandler.mutex.Lock()
+	defer c.networkHandler.mutex.Unlock()
+	c.stderr = stderr
+	c.onExit = onExit
+	c.start()
+	go c.abort(message, c.networkHandler.config.ExitStatus.SetupFailure)
+	return nil
+}
+
+// start marks the channel as running and registers it with the network handler. The network handler mutex must be
+// held when calling this function.
+func (c *channelHandler) start() {
+	c.running = true
+	c.networkHandler.channels[c.channelID] = c
+}
+
+// exit sends the exit status to the client once, regardless of how many times it is called.
+func (c *channelHandler) exit(exitStatus sshserver.ExitStatus) {
+	c.networkHandler.mutex.Lock()
+	if !c.running {
+		c.networkHandler.mutex.Unlock()
+		return
+	}
+	c.running = false
+	delete(c.networkHandler.channels, c.channelID)
+	c.networkHandler.lastExitStatus = exitStatus
+	c.networkHandler.sessionExited = true
+	onExit := c.onExit
+	c.networkHandler.mutex.Unlock()
+
+	c.networkHandler.hooks.OnSessionExit(c.channelID, exitStatus)
+	c.networkHandler.recordEvent(
+		corev1.EventTypeNormal,
+		eventReasonSessionExited,
+		"Session %d exited with status %d",
+		c.channelID,
+		exitStatus,
+	)
+	onExit(exitStatus)
+}
+
+// abort informs the user about the reason on stderr and closes the session with the specified exit status without
+// waiting for the program to finish.
+func (c *channelHandler) abort(message string, exitStatus sshserver.ExitStatus) {
+	c.message(message)
+	c.exit(exitStatus)
+}
+
+// message writes a message for the user to stderr of the session.
+func (c *channelHandler) message(message string) {
+	lineEnding := "\n"
+	if c.pty {
+		lineEnding = "\r\n"
+	}
+	if _, err := c.stderr.Write([]byte(message + lineEnding)); err != nil {
+		c.networkHandler.logger.Debugf("failed to write message to stderr (%v)", err)
+	}
+}
+
+// streamLogs sends the output of the console container in one-shot mode to stdout and exits with the exit code of
+// the container once it terminates.
+func (c *channelHandler) streamLogs(
+	ctx context.Context,
+	stdout io.Writer,
+	container corev1.Container,
+	exit func(exitStatus sshserver.ExitStatus),
+) {
+	n := c.networkHandler
+	pod := n.currentPod()
+
+	logStream, err := n.cli.
+		CoreV1().
+		Pods(pod.Namespace).
+		GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: container.Name,
+			Follow:    true,
+		}).
+		Stream(ctx)
+	if err != nil {
+		n.logger.Warningf("failed to stream one-shot pod logs (%v)", err)
+		c.abort(fmt.Sprintf("failed to stream the output of the pod: %v", err), n.config.ExitStatus.StreamFailure)
+		return
+	}
+	if _, err := io.Copy(stdout, logStream); err != nil {
+		n.logger.Warningf("failed to stream one-shot pod logs (%v)", err)
+	}
+	_ = logStream.Close()
+
+	waitContext, cancel := context.WithTimeout(ctx, n.config.Timeout)
+	defer cancel()
+	if err := n.waitForPodCondition(waitContext, n.isConsoleContainerTerminatedEvent); err != nil {
+		n.logger.Warningf("failed to fetch one-shot pod exit code (%v)", err)
+		c.abort(fmt.Sprintf("failed to fetch the exit code of the pod: %v", err), n.config.ExitStatus.StreamFailure)
+		return
+	}
+	status := n.consoleContainerStatus(n.currentPod())
+	exit(sshserver.ExitStatus(status.State.Terminated.ExitCode))
+}
+
 func (c *channelHandler) streamIO(
+	ctx context.Context,
 	program []string,
 	stdin io.Reader,
 	stdout io.Writer,
@@ -134,10 +356,14 @@ func (c *channelHandler) streamIO(
 ) {
 	c.initTerminalSizeQueue()
 
-	c.stream(program, container, stdin, stdout, stderr, exit)
+	c.stream(ctx, program, container, stdin, stdout, stderr, exit)
+	c.removeSignalPIDFile()
 }
 
+// stream runs the program in the pod until it exits. If the context is cancelled because the client went away, the
+// program is stopped.
 func (c *channelHandler) stream(
+	ctx context.Context,
 	program []string,
 	container corev1.Container,
 	stdin io.Reader,
@@ -145,49 +371,70 @@ func (c *channelHandler) stream(
 	stderr io.Writer,
 	exit func(exitStatus sshserver.ExitStatus),
 ) {
-	req := c.networkHandler.restClient.Post().
-		Resource("pods").
-		Name(c.networkHandler.pod.Name).
-		Namespace(c.networkHandler.pod.Namespace).
-		SubResource("exec")
-	req.VersionedParams(
+	command := c.networkHandler.wrapEnv(c.programEnv(), program)
+	command, err := c.wrapWorkingDirectory(command)
+	if err != nil {
+		c.networkHandler.logger.Warningf("failed to determine working directory (%v)", err)
+		c.abort(
+			fmt.Sprintf("failed to start the program in the pod: %v", err),
+			c.networkHandler.config.ExitStatus.SetupFailure,
+		)
+		return
+	}
+	command = c.networkHandler.wrapPrivilegeDrop(command)
+	command = c.wrapSignalLauncher(command)
+	exec, err := c.networkHandler.newExecutor(
+		c.networkHandler.currentPod(),
 		&corev1.PodExecOptions{
 			Container: container.Name,
-			Command:   program,
+			Command:   command,
 			Stdin:     true,
 			Stdout:    true,
 			Stderr:    true,
 			TTY:       c.pty,
 		},
-		scheme.ParameterCodec,
-	)
-
-	exec, err := remotecommand.NewSPDYExecutor(
-		&c.networkHandler.restClientConfig,
-		"POST",
-		req.URL(),
 	)
 	if err != nil {
-		exit(137)
 		c.networkHandler.logger.Warningf("failed to stream IO (%v)", err)
+		c.abort(
+			fmt.Sprintf("failed to start the program in the pod: %v", err),
+			c.networkHandler.config.ExitStatus.SetupFailure,
+		)
 		return
 	}
-	if err := exec.Stream(
-		remotecommand.StreamOptions{
-			Stdin:             stdin,
-			Stdout:            stdout,
-			Stderr:            stderr,
-			Tty:               c.pty,
-			TerminalSizeQueue: c.terminalSizeQueue,
-		},
-	); err != nil {
-		exitErr := execUtil.CodeExitError{}
-		if errors.As(err, &exitErr) {
-			exit(sshserver.ExitStatus(exitErr.Code))
+	// The stdin of the program is passed through a pipe so it can be closed when the program is stopped.
+	stdinReader, stdinWriter := io.Pipe()
+	go func() {
+		_, err := io.Copy(stdinWriter, stdin)
+		_ = stdinWriter.CloseWithError(err)
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- exec.Stream(
+			remotecommand.StreamOptions{
+				Stdin:             stdinReader,
+				Stdout:            stdout,
+				Stderr:            stderr,
+				Tty:               c.pty,
+				TerminalSizeQueue: c.terminalSizeQueue,
+			},
+		)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = c.stopProgram(stdinWriter, done)
+	}
+	_ = stdinReader.Close()
+	if err != nil {
+		exitStatus, failure := c.networkHandler.classifyExecError(err)
+		if failure == nil {
+			c.reportExit(exitStatus)
+			exit(exitStatus)
 			return
 		}
 		c.networkHandler.logger.Warningf("failed to stream IO (%v)", err)
-		exit(137)
+		c.abort(failure.message, failure.exitStatus)
 		return
 	} else {
 		exit(0)
@@ -196,14 +443,12 @@ func (c *channelHandler) stream(
 
 func (c *channelHandler) initTerminalSizeQueue() {
 	if c.pty {
-		go func() {
-			c.terminalSizeQueue.Push(
-				remotecommand.TerminalSize{
-					Width:  uint16(c.columns),
-					Height: uint16(c.rows),
-				},
-			)
-		}()
+		c.terminalSizeQueue.Push(
+			remotecommand.TerminalSize{
+				Width:  uint16(c.columns),
+				Height: uint16(c.rows),
+			},
+		)
 	}
 }
 
@@ -215,7 +460,27 @@ func (c *channelHandler) OnExecRequest(
 	stderr io.Writer,
 	onExit func(exitStatus sshserver.ExitStatus),
 ) error {
-	return c.run(c.parseProgram(program), stdin, stdout, stderr, onExit)
+	if c.networkHandler.config.Commands.DisableExec {
+		return c.rejectRequest("exec", fmt.Errorf("exec requests are disabled"))
+	}
+	if forced, ok, err := c.forcedProgram("exec", program); ok {
+		if err != nil {
+			return c.rejectRequest("exec", err)
+		}
+		return c.run("exec", forced, stdin, stdout, stderr, onExit)
+	}
+	if c.networkHandler.hasCommandFilter() {
+		args, err := c.networkHandler.checkCommand(program)
+		if err != nil {
+			return c.rejectRequest("exec", err)
+		}
+		return c.run("exec", args, stdin, stdout, stderr, onExit)
+	}
+	args, err := c.parseProgram(program)
+	if err != nil {
+		return c.rejectRequest("exec", err)
+	}
+	return c.run("exec", args, stdin, stdout, stderr, onExit)
 }
 
 func (c *channelHandler) OnShell(
@@ -225,7 +490,20 @@ func (c *channelHandler) OnShell(
 	stderr io.Writer,
 	onExit func(exitStatus sshserver.ExitStatus),
 ) error {
-	return c.run(c.networkHandler.config.Pod.ShellCommand, stdin, stdout, stderr, onExit)
+	if c.networkHandler.config.Commands.DisableShell {
+		return c.rejectRequest("shell", fmt.Errorf("shell requests are disabled"))
+	}
+	if forced, ok, err := c.forcedProgram("shell", ""); ok {
+		if err != nil {
+			return c.rejectRequest("shell", err)
+		}
+		return c.run("shell", forced, stdin, stdout, stderr, onExit)
+	}
+	program, err := c.networkHandler.shellProgram()
+	if err != nil {
+		return c.fail(err.Error(), stderr, onExit)
+	}
+	return c.run("shell", program, stdin, stdout, stderr, onExit)
 }
 
 func (c *channelHandler) OnSubsystem(
@@ -236,20 +514,32 @@ func (c *channelHandler) OnSubsystem(
 	stderr io.Writer,
 	onExit func(exitStatus sshserver.ExitStatus),
 ) error {
+	for _, disabled := range c.networkHandler.config.Commands.DisabledSubsystems {
+		if disabled == subsystem {
+			return c.rejectRequest("subsystem", fmt.Errorf("the %s subsystem is disabled", subsystem))
+		}
+	}
+	if forced, ok, err := c.forcedProgram("subsystem", ""); ok {
+		if err != nil {
+			return c.rejectRequest("subsystem", err)
+		}
+		return c.run("subsystem "+subsystem, forced, stdin, stdout, stderr, onExit)
+	}
 	if binary, ok := c.networkHandler.config.Pod.Subsystems[subsystem]; ok {
-		return c.run([]string{binary}, stdin, stdout, stderr, onExit)
+		return c.run("subsystem "+subsystem, []string{binary}, stdin, stdout, stderr, onExit)
 	}
 	return fmt.Errorf("subsystem not supported")
 }
 
-func (c *channelHandler) OnSignal(_ uint64, _ string) error {
-	return fmt.Errorf("signals are not supported")
+func (c *channelHandler) OnSignal(_ uint64, signal string) error {
+	return c.sendSignal(signal)
 }
 
 func (c *channelHandler) OnWindow(_ uint64, columns uint32, rows uint32, _ uint32, _ uint32) error {
 	c.sshHandler.mutex.Lock()
-	defer c.sshHandler.mutex.Unlock()
-	if !c.running {
+	running := c.running
+	c.sshHandler.mutex.Unlock()
+	if !running {
 		return fmt.Errorf("program not running")
 	}
 
@@ -1,9 +1,11 @@
 package kuberun
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/containerssh/sshserver"
+	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
@@ -21,13 +23,48 @@ func (s *sshConnectionHandler) OnSessionChannel(channelID uint64, _ []byte) (
 	channel sshserver.SessionChannelHandler,
 	failureReason sshserver.ChannelRejection,
 ) {
+	s.networkHandler.mutex.Lock()
+	closed := s.networkHandler.closed
+	startError := s.networkHandler.startError
+	s.networkHandler.mutex.Unlock()
+	if startError != nil {
+		return nil, &channelRejection{
+			message: fmt.Sprintf("failed to start the pod for this connection: %v", startError),
+			reason:  ssh.ConnectionFailed,
+		}
+	}
+	if closed != nil {
+		return nil, &channelRejection{
+			message: fmt.Sprintf("this connection no longer accepts sessions (%v), please reconnect", closed),
+			reason:  ssh.ConnectionFailed,
+		}
+	}
+	s.networkHandler.startPodInBackground()
 	return &channelHandler{
 		channelID:      channelID,
 		networkHandler: s.networkHandler,
 		sshHandler:     s,
 		env:            map[string]string{},
 		terminalSizeQueue: &sizeQueue{
-			resizeChan: make(chan remotecommand.TerminalSize),
+			resizeChan: make(chan remotecommand.TerminalSize, 1),
 		},
 	}, nil
 }
+
+// channelRejection is the reason a session channel could not be opened.
+type channelRejection struct {
+	message string
+	reason  ssh.RejectionReason
+}
+
+func (c *channelRejection) Error() string {
+	return c.message
+}
+
+func (c *channelRejection) Message() string {
+	return c.message
+}
+
+func (c *channelRejection) Reason() ssh.RejectionReason {
+	return c.reason
+}
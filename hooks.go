@@ -0,0 +1,87 @@
+package kuberun
+
+import (
+	"github.com/containerssh/sshserver"
+	core "k8s.io/api/core/v1"
+)
+
+// LifecycleHooks receives notifications about the pod and the sessions of a connection, so embedding applications
+// can, for example, update a dashboard or assign DNS names. The hooks are called synchronously from the connection
+// handling and should return quickly without calling back into the handler.
+type LifecycleHooks interface {
+	// OnPodCreated is called when a pod has been created, claimed from the warm pool or attached as a workspace for
+	// the connection. Returning an error aborts the connection and the pod is removed.
+	OnPodCreated(pod *core.Pod) error
+	// OnPodReady is called when the pod is ready to run sessions. Returning an error aborts the connection and the
+	// pod is removed.
+	OnPodReady(pod *core.Pod) error
+	// OnPodFailed is called when the pod failed to start, or went away while the connection was active.
+	OnPodFailed(pod *core.Pod, err error)
+	// OnSessionStart is called when a program is started in a session channel.
+	OnSessionStart(channelID uint64, program []string)
+	// OnSessionExit is called when the program in a session channel exits.
+	OnSessionExit(channelID uint64, exitStatus sshserver.ExitStatus)
+	// OnPodDeleted is called when the pod of the connection has been removed. The error is set if the removal failed.
+	OnPodDeleted(pod *core.Pod, err error)
+}
+
+// NoopLifecycleHooks implements LifecycleHooks without doing anything. It can be embedded to implement only some of
+// the hooks.
+type NoopLifecycleHooks struct{}
+
+func (NoopLifecycleHooks) OnPodCreated(_ *core.Pod) error { return nil }
+
+func (NoopLifecycleHooks) OnPodReady(_ *core.Pod) error { return nil }
+
+func (NoopLifecycleHooks) OnPodFailed(_ *core.Pod, _ error) {}
+
+func (NoopLifecycleHooks) OnSessionStart(_ uint64, _ []string) {}
+
+func (NoopLifecycleHooks) OnSessionExit(_ uint64, _ sshserver.ExitStatus) {}
+
+func (NoopLifecycleHooks) OnPodDeleted(_ *core.Pod, _ error) {}
+
+// lifecycleHooks calls all hooks passed to New in order. The pre-ready hooks stop at the first error.
+type lifecycleHooks []LifecycleHooks
+
+func (h lifecycleHooks) OnPodCreated(pod *core.Pod) error {
+	for _, hook := range h {
+		if err := hook.OnPodCreated(pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h lifecycleHooks) OnPodReady(pod *core.Pod) error {
+	for _, hook := range h {
+		if err := hook.OnPodReady(pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h lifecycleHooks) OnPodFailed(pod *core.Pod, err error) {
+	for _, hook := range h {
+		hook.OnPodFailed(pod, err)
+	}
+}
+
+func (h lifecycleHooks) OnSessionStart(channelID uint64, program []string) {
+	for _, hook := range h {
+		hook.OnSessionStart(channelID, program)
+	}
+}
+
+func (h lifecycleHooks) OnSessionExit(channelID uint64, exitStatus sshserver.ExitStatus) {
+	for _, hook := range h {
+		hook.OnSessionExit(channelID, exitStatus)
+	}
+}
+
+func (h lifecycleHooks) OnPodDeleted(pod *core.Pod, err error) {
+	for _, hook := range h {
+		hook.OnPodDeleted(pod, err)
+	}
+}
@@ -0,0 +1,54 @@
+package kuberun
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containerssh/sshserver"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+)
+
+type recordingHooks struct {
+	NoopLifecycleHooks
+	events       []string
+	createdError error
+}
+
+func (r *recordingHooks) OnPodCreated(pod *core.Pod) error {
+	r.events = append(r.events, "created "+pod.Name)
+	return r.createdError
+}
+
+func (r *recordingHooks) OnSessionExit(channelID uint64, exitStatus sshserver.ExitStatus) {
+	r.events = append(r.events, fmt.Sprintf("exit %d %d", channelID, exitStatus))
+}
+
+func TestPodCreatedHookErrorShouldStopLaterHooks(t *testing.T) {
+	first := &recordingHooks{createdError: fmt.Errorf("no DNS name available")}
+	second := &recordingHooks{}
+	hooks := lifecycleHooks{first, second}
+
+	err := hooks.OnPodCreated(&core.Pod{})
+	assert.Error(t, err)
+	assert.Len(t, first.events, 1)
+	assert.Len(t, second.events, 0)
+}
+
+func TestSessionExitShouldCallHookOnce(t *testing.T) {
+	hooks := &recordingHooks{}
+	n := newTestNetworkHandler(t)
+	n.hooks = lifecycleHooks{hooks}
+	channel := &channelHandler{
+		networkHandler: n,
+		channelID:      3,
+		onExit:         func(_ sshserver.ExitStatus) {},
+	}
+	n.mutex.Lock()
+	channel.start()
+	n.mutex.Unlock()
+
+	channel.exit(42)
+	channel.exit(0)
+	assert.Equal(t, []string{"exit 3 42"}, hooks.events)
+}
@@ -56,6 +56,37 @@ func TestSuccessfulHandshakeShouldCreatePod(t *testing.T) {
 	assert.Equal(t, true, *podList.Items[0].Status.ContainerStatuses[0].Started)
 }
 
+func TestSessionStartModeShouldNotCreatePodWithoutSession(t *testing.T) {
+	t.Parallel()
+
+	config := kuberun.Config{}
+	structutils.Defaults(&config)
+	config.StartMode = kuberun.StartModeSession
+
+	if err := kuberun.SetConfigFromKubeConfig(&config); err != nil {
+		assert.FailNow(t, "failed to create configuration from the current users kubeconfig (%v)", err)
+	}
+
+	connectionID := sshserver.GenerateConnectionID()
+	logger := getLogger(t)
+
+	kr := createKuberun(t, connectionID, config, logger)
+
+	_, err := kr.OnHandshakeSuccess("test")
+	assert.Nil(t, err, "failed to create handshake handler (%v)", err)
+	kr.OnDisconnect()
+
+	k8sConfig := kuberun.CreateConnectionConfig(config)
+	cli, err := kubernetes.NewForConfig(&k8sConfig)
+	assert.Nil(t, err, "failed to create k8s client (%v)", err)
+
+	podList, err := cli.CoreV1().Pods(config.Pod.Namespace).List(context.Background(), v1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", "containerssh_connection_id", connectionID),
+	})
+	assert.Nil(t, err, "failed to list k8s pods (%v)", err)
+	assert.Equal(t, 0, len(podList.Items))
+}
+
 func TestSingleSessionShouldRunProgram(t *testing.T) {
 	t.Parallel()
 
@@ -118,6 +149,115 @@ func TestCommandExecutionShouldReturnStatusCode(t *testing.T) {
 	assert.Equal(t, 42, status)
 }
 
+func TestSessionEnvShouldReachProgram(t *testing.T) {
+	t.Parallel()
+
+	_, session, kr := setupKuberun(t)
+	defer kr.OnDisconnect()
+
+	must(t, assert.NoError(t, session.OnEnvRequest(0, "FOO", "it's \"quoted\"")))
+	must(t, assert.NoError(t, session.OnPtyRequest(1, "xterm-256color", 80, 25, 800, 600, []byte{})))
+
+	stdin := bytes.NewReader([]byte{})
+	var stdoutBytes bytes.Buffer
+	stdout := bufio.NewWriter(&stdoutBytes)
+	var stderrBytes bytes.Buffer
+	stderr := bufio.NewWriter(&stderrBytes)
+	done := make(chan struct{})
+	status := 0
+	err := session.OnExecRequest(
+		2,
+		"echo \"$FOO $TERM $CONTAINERSSH_USERNAME\"",
+		stdin,
+		stdout,
+		stderr,
+		func(exitStatus sshserver.ExitStatus) {
+			status = int(exitStatus)
+			done <- struct{}{}
+		},
+	)
+	assert.Nil(t, err)
+	<-done
+	assert.Nil(t, stdout.Flush())
+	assert.Equal(t, "it's \"quoted\" xterm-256color test\r\n", stdoutBytes.String())
+	assert.Equal(t, 0, status)
+}
+
+func TestSessionEnvAllowListShouldRestrictVariables(t *testing.T) {
+	t.Parallel()
+
+	_, session, kr := setupKuberunWithConfig(t, func(config *kuberun.Config) {
+		config.Env.Allow = []string{"LANG", "LC_*"}
+	})
+	defer kr.OnDisconnect()
+
+	must(t, assert.NoError(t, session.OnEnvRequest(0, "LC_FOO", "allowed")))
+	assert.Error(t, session.OnEnvRequest(1, "FOO", "not allowed"))
+	assert.Error(t, session.OnEnvRequest(2, "LD_PRELOAD", "/tmp/x.so"))
+
+	stdin := bytes.NewReader([]byte{})
+	var stdoutBytes bytes.Buffer
+	stdout := bufio.NewWriter(&stdoutBytes)
+	var stderrBytes bytes.Buffer
+	stderr := bufio.NewWriter(&stderrBytes)
+	done := make(chan struct{})
+	status := 0
+	err := session.OnExecRequest(
+		3,
+		"echo \"$LC_FOO:$FOO:$LD_PRELOAD\"",
+		stdin,
+		stdout,
+		stderr,
+		func(exitStatus sshserver.ExitStatus) {
+			status = int(exitStatus)
+			done <- struct{}{}
+		},
+	)
+	assert.Nil(t, err)
+	<-done
+	assert.Nil(t, stdout.Flush())
+	assert.Equal(t, "allowed::\n", stdoutBytes.String())
+	assert.Equal(t, 0, status)
+}
+
+func TestSignalShouldInterruptProgram(t *testing.T) {
+	t.Parallel()
+
+	_, session, kr := setupKuberunWithConfig(t, func(config *kuberun.Config) {
+		config.Pod.Signals.Enable = true
+	})
+	defer kr.OnDisconnect()
+
+	stdin, stdinWriter := io.Pipe()
+	defer func() {
+		_ = stdinWriter.Close()
+	}()
+	var stdoutBytes bytes.Buffer
+	var stderrBytes bytes.Buffer
+	done := make(chan int, 1)
+	err := session.OnExecRequest(
+		0,
+		"sleep 600",
+		stdin,
+		&stdoutBytes,
+		&stderrBytes,
+		func(exitStatus sshserver.ExitStatus) {
+			done <- int(exitStatus)
+		},
+	)
+	must(t, assert.Nil(t, err))
+
+	// Give the launcher time to record the PID.
+	time.Sleep(2 * time.Second)
+	must(t, assert.NoError(t, session.OnSignal(1, "TERM")))
+	select {
+	case status := <-done:
+		assert.NotEqual(t, 0, status)
+	case <-time.After(30 * time.Second):
+		assert.Fail(t, "the program was not interrupted by the signal")
+	}
+}
+
 func TestSingleSessionShouldRunShell(t *testing.T) {
 	t.Parallel()
 
@@ -170,10 +310,18 @@ func TestSingleSessionShouldRunShell(t *testing.T) {
 }
 
 func setupKuberun(t *testing.T) (log.Logger, sshserver.SessionChannelHandler, sshserver.NetworkConnectionHandler) {
+	return setupKuberunWithConfig(t, func(_ *kuberun.Config) {})
+}
+
+func setupKuberunWithConfig(
+	t *testing.T,
+	configure func(config *kuberun.Config),
+) (log.Logger, sshserver.SessionChannelHandler, sshserver.NetworkConnectionHandler) {
 	config := kuberun.Config{}
 	structutils.Defaults(&config)
 
 	config.Pod.ShellCommand = []string{"/bin/sh"}
+	configure(&config)
 
 	err := kuberun.SetConfigFromKubeConfig(&config)
 	assert.Nil(t, err, "failed to set up kube config (%v)", err)
@@ -0,0 +1,210 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+)
+
+// resolveOwnerReferences returns the owner references to set on the pod of this connection according to the owner
+// configuration. The owner must exist in the namespace of the pod.
+func (n *networkHandler) resolveOwnerReferences(ctx context.Context) ([]meta.OwnerReference, error) {
+	switch n.config.Owner.Mode {
+	case OwnerModeNone:
+		return nil, nil
+	case OwnerModeSelf:
+		owner, err := resolveSelfOwner(ctx, n.config, n.cli)
+		if err != nil {
+			return nil, err
+		}
+		return []meta.OwnerReference{*owner}, nil
+	case OwnerModeObject:
+		owner, err := resolveObjectOwner(ctx, n.config, n.restClientConfig)
+		if err != nil {
+			return nil, err
+		}
+		return []meta.OwnerReference{*owner}, nil
+	case OwnerModeConfigMap:
+		if n.config.Workspace.Enable {
+			return nil, nil
+		}
+		owner, err := n.createSessionConfigMap(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []meta.OwnerReference{*owner}, nil
+	default:
+		return nil, fmt.Errorf("invalid owner mode: %s", n.config.Owner.Mode)
+	}
+}
+
+// resolvePoolOwnerReferences returns the owner references to set on unassigned warm pool pods. Pool pods are not
+// owned by a connection, so in configMap mode they are owned by the ContainerSSH pod if it is known from the downward
+// API, like the ConfigMaps.
+func resolvePoolOwnerReferences(
+	ctx context.Context,
+	config Config,
+	cli kubernetes.Interface,
+	restClientConfig restclient.Config,
+) ([]meta.OwnerReference, error) {
+	switch config.Owner.Mode {
+	case OwnerModeSelf:
+		owner, err := resolveSelfOwner(ctx, config, cli)
+		if err != nil {
+			return nil, err
+		}
+		return []meta.OwnerReference{*owner}, nil
+	case OwnerModeObject:
+		owner, err := resolveObjectOwner(ctx, config, restClientConfig)
+		if err != nil {
+			return nil, err
+		}
+		return []meta.OwnerReference{*owner}, nil
+	case OwnerModeConfigMap:
+		if os.Getenv(config.Owner.PodNameEnv) == "" {
+			return nil, nil
+		}
+		owner, err := resolveSelfOwner(ctx, config, cli)
+		if err != nil {
+			return nil, err
+		}
+		return []meta.OwnerReference{*owner}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// resolveSelfOwner returns a reference to the ContainerSSH pod, using the pod name and namespace exposed via the
+// downward API.
+func resolveSelfOwner(ctx context.Context, config Config, cli kubernetes.Interface) (*meta.OwnerReference, error) {
+	name := os.Getenv(config.Owner.PodNameEnv)
+	namespace := os.Getenv(config.Owner.PodNamespaceEnv)
+	if name == "" || namespace == "" {
+		return nil, fmt.Errorf(
+			"the %s and %s environment variables must be set via the downward API to use the ContainerSSH pod as owner",
+			config.Owner.PodNameEnv,
+			config.Owner.PodNamespaceEnv,
+		)
+	}
+	if namespace != config.Pod.Namespace {
+		return nil, fmt.Errorf(
+			"the owner pod %s is in namespace %s, but pods are created in namespace %s",
+			name,
+			namespace,
+			config.Pod.Namespace,
+		)
+	}
+	pod, err := cli.CoreV1().Pods(namespace).Get(ctx, name, meta.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch owner pod %s (%w)", name, err)
+	}
+	return &meta.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}, nil
+}
+
+// resolveObjectOwner returns a reference to the configured owner object after checking that it exists in the pod
+// namespace.
+func resolveObjectOwner(
+	ctx context.Context,
+	config Config,
+	restClientConfig restclient.Config,
+) (*meta.OwnerReference, error) {
+	owner := config.Owner
+	groupVersion, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner API version %s (%w)", owner.APIVersion, err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(&restClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	object, err := dynamicClient.
+		Resource(groupVersion.WithResource(owner.Resource)).
+		Namespace(config.Pod.Namespace).
+		Get(ctx, owner.Name, meta.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf(
+				"the owner %s %s does not exist in namespace %s",
+				owner.Kind,
+				owner.Name,
+				config.Pod.Namespace,
+			)
+		}
+		return nil, fmt.Errorf("failed to fetch owner %s %s (%w)", owner.Kind, owner.Name, err)
+	}
+	if object.GetNamespace() != config.Pod.Namespace {
+		return nil, fmt.Errorf("the owner %s %s is not in namespace %s", owner.Kind, owner.Name, config.Pod.Namespace)
+	}
+	return &meta.OwnerReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       object.GetName(),
+		UID:        object.GetUID(),
+	}, nil
+}
+
+// sessionConfigMapName returns the name of the ConfigMap owning the pod of the connection in configMap owner mode.
+func (n *networkHandler) sessionConfigMapName() string {
+	return "containerssh-" + n.connectionID
+}
+
+// createSessionConfigMap creates the per-connection ConfigMap that owns the pod. If the ContainerSSH pod is known
+// from the downward API, the ConfigMap is in turn owned by it.
+func (n *networkHandler) createSessionConfigMap(ctx context.Context) (*meta.OwnerReference, error) {
+	configMap := &core.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      n.sessionConfigMapName(),
+			Namespace: n.config.Pod.Namespace,
+			Labels:    n.labels,
+		},
+	}
+	if os.Getenv(n.config.Owner.PodNameEnv) != "" {
+		owner, err := resolveSelfOwner(ctx, n.config, n.cli)
+		if err != nil {
+			return nil, err
+		}
+		configMap.OwnerReferences = []meta.OwnerReference{*owner}
+	}
+	configMap, err := n.cli.CoreV1().ConfigMaps(n.config.Pod.Namespace).Create(ctx, configMap, meta.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session ConfigMap (%w)", err)
+	}
+	return &meta.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       configMap.Name,
+		UID:        configMap.UID,
+	}, nil
+}
+
+// removeSessionConfigMap removes the per-connection ConfigMap. If orphan is true the pod owned by it is kept.
+func (n *networkHandler) removeSessionConfigMap(ctx context.Context, orphan bool) {
+	if n.config.Owner.Mode != OwnerModeConfigMap || n.config.Workspace.Enable {
+		return
+	}
+	propagationPolicy := meta.DeletePropagationBackground
+	if orphan {
+		propagationPolicy = meta.DeletePropagationOrphan
+	}
+	err := n.cli.CoreV1().ConfigMaps(n.config.Pod.Namespace).Delete(
+		ctx,
+		n.sessionConfigMapName(),
+		meta.DeleteOptions{PropagationPolicy: &propagationPolicy},
+	)
+	if err != nil && !errors.IsNotFound(err) {
+		n.logger.Warningf("failed to remove session ConfigMap (%v)", err)
+	}
+}
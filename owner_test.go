@@ -0,0 +1,59 @@
+package kuberun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSelfOwnerShouldReferenceContainerSSHPod(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Owner.Mode = OwnerModeSelf
+	n.cli = fake.NewSimpleClientset(&core.Pod{
+		ObjectMeta: meta.ObjectMeta{Name: "containerssh-0", Namespace: n.config.Pod.Namespace, UID: "1234"},
+	})
+	t.Setenv(n.config.Owner.PodNameEnv, "containerssh-0")
+	t.Setenv(n.config.Owner.PodNamespaceEnv, n.config.Pod.Namespace)
+
+	ownerReferences, err := n.resolveOwnerReferences(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, ownerReferences, 1)
+	assert.Equal(t, "Pod", ownerReferences[0].Kind)
+	assert.Equal(t, "containerssh-0", ownerReferences[0].Name)
+	assert.Equal(t, "1234", string(ownerReferences[0].UID))
+}
+
+func TestSelfOwnerInOtherNamespaceShouldFail(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Owner.Mode = OwnerModeSelf
+	n.cli = fake.NewSimpleClientset()
+	t.Setenv(n.config.Owner.PodNameEnv, "containerssh-0")
+	t.Setenv(n.config.Owner.PodNamespaceEnv, "other")
+
+	_, err := n.resolveOwnerReferences(context.Background())
+	assert.Error(t, err)
+}
+
+func TestConfigMapOwnerShouldBeRemovedWithoutPod(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Owner.Mode = OwnerModeConfigMap
+	n.connectionID = "abcd"
+	n.cli = fake.NewSimpleClientset()
+
+	ownerReferences, err := n.resolveOwnerReferences(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, ownerReferences, 1)
+	assert.Equal(t, "ConfigMap", ownerReferences[0].Kind)
+
+	n.removeSessionConfigMap(context.Background(), false)
+	_, err = n.cli.CoreV1().ConfigMaps(n.config.Pod.Namespace).Get(
+		context.Background(),
+		n.sessionConfigMapName(),
+		meta.GetOptions{},
+	)
+	assert.Error(t, err)
+}
@@ -0,0 +1,197 @@
+package kuberun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/remotecommand"
+	execUtil "k8s.io/client-go/util/exec"
+	"k8s.io/kubectl/pkg/scheme"
+)
+
+// initializedAnnotation marks workspace pods on which the init commands have already run.
+const initializedAnnotation = "containerssh.io/initialized"
+
+// newExecutor creates an executor running a command in the pod with the specified options.
+func (n *networkHandler) newExecutor(pod *core.Pod, options *core.PodExecOptions) (remotecommand.Executor, error) {
+	if n.executorFactory != nil {
+		return n.executorFactory(pod, options)
+	}
+	req := n.restClient.Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec")
+	req.VersionedParams(options, scheme.ParameterCodec)
+
+	return remotecommand.NewSPDYExecutor(
+		&n.restClientConfig,
+		"POST",
+		req.URL(),
+	)
+}
+
+// podCommandResult is the outcome of a command executed in the pod outside of a session.
+type podCommandResult struct {
+	exitCode int
+	output   string
+}
+
+// podCommandTimeout returns how long the command may run.
+func (n *networkHandler) podCommandTimeout(command PodCommand) time.Duration {
+	if command.Timeout > 0 {
+		return command.Timeout
+	}
+	return n.config.Timeout
+}
+
+// execPodCommand runs the command in the pod without a session and captures its output. The command is abandoned
+// when the timeout of the command expires, but it may keep running in the container. The executor of this client-go
+// version cannot be cancelled, so the goroutine streaming the output also stays until the command exits or the
+// kubelet closes the idle stream. It only holds the output buffer, which is no longer read.
+func (n *networkHandler) execPodCommand(ctx context.Context, pod *core.Pod, command PodCommand) (podCommandResult, error) {
+	container := command.Container
+	if container == "" {
+		container = n.config.Pod.Spec.Containers[n.config.Pod.ConsoleContainerNumber].Name
+	}
+	timeout := n.podCommandTimeout(command)
+	ctx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
+
+	exec, err := n.newExecutor(pod, &core.PodExecOptions{
+		Container: container,
+		Command:   command.Command,
+		Stdout:    true,
+		Stderr:    true,
+	})
+	if err != nil {
+		return podCommandResult{}, err
+	}
+
+	output := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- exec.Stream(remotecommand.StreamOptions{
+			Stdout: output,
+			Stderr: output,
+		})
+	}()
+
+	select {
+	case <-ctx.Done():
+		return podCommandResult{output: output.String()}, fmt.Errorf(
+			"command did not finish in %s (%w)",
+			timeout,
+			ctx.Err(),
+		)
+	case err := <-done:
+		result := podCommandResult{output: output.String()}
+		if err != nil {
+			exitErr := execUtil.CodeExitError{}
+			if errors.As(err, &exitErr) {
+				result.exitCode = exitErr.Code
+				return result, fmt.Errorf("command exited with status %d", exitErr.Code)
+			}
+			return result, err
+		}
+		return result, nil
+	}
+}
+
+// runPodCommand executes a command in the pod and logs its outcome and output.
+func (n *networkHandler) runPodCommand(ctx context.Context, pod *core.Pod, kind string, command PodCommand) error {
+	result, err := n.execPodCommand(ctx, pod, command)
+	output := strings.TrimSpace(result.output)
+	if err != nil {
+		n.logger.Warningf("%s command %v failed on pod %s (%v): %s", kind, command.Command, pod.Name, err, output)
+		return err
+	}
+	n.logger.Debugf("%s command %v succeeded on pod %s: %s", kind, command.Command, pod.Name, output)
+	return nil
+}
+
+// runInitCommands runs the init commands in order in a newly started pod, after the home directory of the mapped user
+// was created. Workspace pods are only initialized once.
+func (n *networkHandler) runInitCommands(ctx context.Context) error {
+	pod := n.currentPod()
+	if len(n.config.Pod.InitCommands) == 0 || n.config.Pod.OneShot {
+		return nil
+	}
+	if n.config.Workspace.Enable && pod.Annotations[initializedAnnotation] == "true" {
+		return nil
+	}
+	for _, command := range n.config.Pod.InitCommands {
+		if err := n.runPodCommand(ctx, pod, "init", command); err != nil {
+			if command.OnFailure == PodCommandFailureContinue {
+				continue
+			}
+			return fmt.Errorf("init command %v failed (%w)", command.Command, err)
+		}
+	}
+	if n.config.Workspace.Enable {
+		return n.markInitialized(ctx, pod)
+	}
+	return nil
+}
+
+// runLogoutCommands runs the logout commands in order if the pod is still running. Each command is bounded by its own
+// timeout and failures do not stop the following commands.
+func (n *networkHandler) runLogoutCommands() {
+	n.mutex.Lock()
+	pod := n.pod
+	startError := n.startError
+	n.mutex.Unlock()
+	if len(n.config.Pod.LogoutCommands) == 0 || n.config.Pod.OneShot || pod == nil || startError != nil {
+		return
+	}
+	if !isPodReady(pod) || pod.DeletionTimestamp != nil {
+		n.logger.Debugf("not running logout commands, pod %s is no longer running", pod.Name)
+		return
+	}
+	for _, command := range n.config.Pod.LogoutCommands {
+		_ = n.runPodCommand(context.Background(), pod, "logout", command)
+	}
+}
+
+// markInitialized records on a workspace pod that the init commands have run.
+func (n *networkHandler) markInitialized(ctx context.Context, pod *core.Pod) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				initializedAnnotation: "true",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = n.cli.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, meta.PatchOptions{})
+	return err
+}
+
+// lockedBuffer is a buffer that can be written from the stdout and stderr streams at the same time.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.String()
+}
@@ -0,0 +1,258 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// stubExecutor runs the stream function instead of a command in the pod.
+type stubExecutor struct {
+	stream func(options remotecommand.StreamOptions) error
+}
+
+func (s *stubExecutor) Stream(options remotecommand.StreamOptions) error {
+	return s.stream(options)
+}
+
+// callLog records the order of the commands executed and the API calls made.
+type callLog struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (c *callLog) add(call string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func (c *callLog) get() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+// stubExecutorFactory returns an executor factory recording the commands in the log. The executors run the function
+// registered for the first argument of the command, or succeed if there is none.
+func stubExecutorFactory(
+	calls *callLog,
+	commands map[string]func(options remotecommand.StreamOptions) error,
+) func(pod *core.Pod, options *core.PodExecOptions) (remotecommand.Executor, error) {
+	return func(_ *core.Pod, options *core.PodExecOptions) (remotecommand.Executor, error) {
+		calls.add(strings.Join(options.Command, " "))
+		stream := commands[options.Command[0]]
+		if stream == nil {
+			stream = func(_ remotecommand.StreamOptions) error { return nil }
+		}
+		return &stubExecutor{stream: stream}, nil
+	}
+}
+
+// newCommandTestNetworkHandler creates a network handler with a running pod in a fake cluster. Commands executed in
+// the pod and pod deletions are recorded in the returned log.
+func newCommandTestNetworkHandler(
+	t *testing.T,
+	commands map[string]func(options remotecommand.StreamOptions) error,
+) (*networkHandler, *fake.Clientset, *callLog) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        "test",
+			Namespace:   n.config.Pod.Namespace,
+			UID:         "test-uid",
+			Annotations: map[string]string{},
+		},
+		Status: core.PodStatus{
+			Phase:      core.PodRunning,
+			Conditions: []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}},
+		},
+	}
+	cli := fake.NewSimpleClientset(pod)
+	calls := &callLog{}
+	cli.PrependReactor("delete", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		calls.add("delete " + action.(k8sTesting.DeleteAction).GetName())
+		return false, nil, nil
+	})
+	n.cli = cli
+	n.pod = pod
+	n.ready = make(chan struct{})
+	close(n.ready)
+	n.executorFactory = stubExecutorFactory(calls, commands)
+	return n, cli, calls
+}
+
+// newStartTestNetworkHandler creates a network handler starting its pod in the fake cluster, where new pods are
+// immediately ready. Commands executed in the pod are recorded in the returned log.
+func newStartTestNetworkHandler(
+	t *testing.T,
+	cli *fake.Clientset,
+	connectionID string,
+	commands map[string]func(options remotecommand.StreamOptions) error,
+) (*networkHandler, *callLog) {
+	n := newTestNetworkHandler(t)
+	n.cli = cli
+	n.connectionID = connectionID
+	n.username = "test"
+	calls := &callLog{}
+	n.executorFactory = stubExecutorFactory(calls, commands)
+	t.Cleanup(func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		if n.cancelMonitor != nil {
+			n.cancelMonitor()
+		}
+	})
+	return n, calls
+}
+
+// newReadyPodClientset creates a fake cluster in which created pods are immediately running and ready.
+func newReadyPodClientset() *fake.Clientset {
+	cli := fake.NewSimpleClientset()
+	cli.PrependReactor("create", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod)
+		if pod.Name == "" {
+			pod.Name = pod.GenerateName + "test"
+		}
+		pod.Status = core.PodStatus{
+			Phase:      core.PodRunning,
+			Conditions: []core.PodCondition{{Type: core.PodReady, Status: core.ConditionTrue}},
+		}
+		return false, nil, nil
+	})
+	return cli
+}
+
+// startAndWait starts the pod of the connection and returns the error that failed the connection, if any.
+func startAndWait(t *testing.T, n *networkHandler) error {
+	n.startPodInBackground()
+	select {
+	case <-n.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("starting the pod did not finish")
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.startError
+}
+
+func TestLogoutCommandsShouldBeSkippedWhenPodStopped(t *testing.T) {
+	n, _, calls := newCommandTestNetworkHandler(t, nil)
+	n.config.Pod.LogoutCommands = []PodCommand{{Command: []string{"/bin/sync"}}}
+	n.pod.Status.Phase = core.PodFailed
+
+	n.runLogoutCommands()
+	assert.Empty(t, calls.get())
+}
+
+func TestLogoutCommandsShouldRunInOrderBeforePodDeletion(t *testing.T) {
+	n, cli, calls := newCommandTestNetworkHandler(t, nil)
+	n.config.Pod.LogoutCommands = []PodCommand{
+		{Command: []string{"/bin/first"}},
+		{Command: []string{"/bin/second", "arg"}},
+		{Command: []string{"/bin/third"}},
+	}
+
+	n.OnDisconnect()
+
+	assert.Equal(t, []string{"/bin/first", "/bin/second arg", "/bin/third", "delete test"}, calls.get())
+	_, err := cli.CoreV1().Pods(n.config.Pod.Namespace).Get(n.connectionContext, "test", meta.GetOptions{})
+	assert.Error(t, err)
+}
+
+func TestFailedLogoutCommandsShouldNotPreventPodDeletion(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	n, cli, calls := newCommandTestNetworkHandler(t, map[string]func(options remotecommand.StreamOptions) error{
+		"/bin/fail": func(options remotecommand.StreamOptions) error {
+			_, _ = options.Stderr.Write([]byte("failed"))
+			return fmt.Errorf("command failed")
+		},
+		"/bin/hang": func(_ remotecommand.StreamOptions) error {
+			<-release
+			return nil
+		},
+	})
+	n.config.Pod.LogoutCommands = []PodCommand{
+		{Command: []string{"/bin/fail"}},
+		{Command: []string{"/bin/hang"}, Timeout: 10 * time.Millisecond},
+		{Command: []string{"/bin/last"}},
+	}
+
+	n.OnDisconnect()
+
+	assert.Equal(t, []string{"/bin/fail", "/bin/hang", "/bin/last", "delete test"}, calls.get())
+	_, err := cli.CoreV1().Pods(n.config.Pod.Namespace).Get(n.connectionContext, "test", meta.GetOptions{})
+	assert.Error(t, err)
+}
+
+func TestFailingInitCommandShouldAbortConnection(t *testing.T) {
+	n, calls := newStartTestNetworkHandler(t, newReadyPodClientset(), "test", map[string]func(options remotecommand.StreamOptions) error{
+		"/bin/fail": func(_ remotecommand.StreamOptions) error {
+			return fmt.Errorf("command failed")
+		},
+	})
+	n.config.Pod.InitCommands = []PodCommand{
+		{Command: []string{"/bin/fail"}, OnFailure: PodCommandFailureAbort},
+		{Command: []string{"/bin/next"}},
+	}
+
+	err := startAndWait(t, n)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "/bin/fail")
+	assert.Equal(t, []string{"/bin/fail"}, calls.get())
+}
+
+func TestFailingInitCommandShouldContinueIfConfigured(t *testing.T) {
+	n, calls := newStartTestNetworkHandler(t, newReadyPodClientset(), "test", map[string]func(options remotecommand.StreamOptions) error{
+		"/bin/fail": func(_ remotecommand.StreamOptions) error {
+			return fmt.Errorf("command failed")
+		},
+	})
+	n.config.Pod.InitCommands = []PodCommand{
+		{Command: []string{"/bin/fail"}, OnFailure: PodCommandFailureContinue},
+		{Command: []string{"/bin/next"}},
+	}
+
+	assert.NoError(t, startAndWait(t, n))
+	assert.Equal(t, []string{"/bin/fail", "/bin/next"}, calls.get())
+}
+
+func TestInitCommandsShouldRunOnceOnWorkspacePod(t *testing.T) {
+	cli := newReadyPodClientset()
+	configure := func(n *networkHandler) {
+		n.config.GC.Enable = true
+		n.config.Workspace.Enable = true
+		n.config.Pod.InitCommands = []PodCommand{{Command: []string{"/bin/init"}}}
+	}
+
+	first, firstCalls := newStartTestNetworkHandler(t, cli, "first", nil)
+	configure(first)
+	assert.NoError(t, startAndWait(t, first))
+	assert.Equal(t, []string{"/bin/init"}, firstCalls.get())
+
+	pod, err := cli.CoreV1().Pods(first.config.Pod.Namespace).Get(
+		context.Background(),
+		workspacePodName(first.config.Profile, "test"),
+		meta.GetOptions{},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", pod.Annotations[initializedAnnotation])
+
+	second, secondCalls := newStartTestNetworkHandler(t, cli, "second", nil)
+	configure(second)
+	assert.NoError(t, startAndWait(t, second))
+	assert.Empty(t, secondCalls.get())
+	assert.Equal(t, pod.Name, second.currentPod().Name)
+}
@@ -0,0 +1,138 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchTools "k8s.io/client-go/tools/watch"
+)
+
+// deleteOptions returns the options for removing the pod according to the deletion policy.
+func (n *networkHandler) deleteOptions(pod *core.Pod) meta.DeleteOptions {
+	options := meta.DeleteOptions{}
+	if n.config.Delete.GracePeriodSeconds >= 0 {
+		gracePeriod := n.config.Delete.GracePeriodSeconds
+		options.GracePeriodSeconds = &gracePeriod
+	}
+	if n.config.Delete.PropagationPolicy != "" {
+		propagationPolicy := n.config.Delete.PropagationPolicy
+		options.PropagationPolicy = &propagationPolicy
+	}
+	if n.config.Delete.CheckUID {
+		uid := pod.UID
+		options.Preconditions = &meta.Preconditions{UID: &uid}
+	}
+	return options
+}
+
+// removePod deletes the pod, retrying until the context expires. If the deletion policy requires it, it also waits
+// for the pod to be gone. It returns an error if the pod could not be removed.
+func (n *networkHandler) removePod(ctx context.Context, pod *core.Pod) error {
+	for {
+		err := n.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, n.deleteOptions(pod))
+		if err == nil {
+			break
+		}
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if errors.IsConflict(err) {
+			n.logger.Infof("pod %s has been replaced, not removing it (%v)", pod.Name, err)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			n.logger.Errorf("failed to remove pod, giving up (%v)", err)
+			return err
+		default:
+			n.logger.Warningf("failed to remove pod, retrying in 10 seconds (%v)", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	if !n.config.Delete.Wait {
+		return nil
+	}
+	waitContext, cancelFunc := context.WithTimeout(context.Background(), n.config.Delete.WaitTimeout)
+	defer cancelFunc()
+	if err := waitForPodDeletion(waitContext, n.cli, pod); err != nil {
+		n.logger.Warningf("pod %s was not removed in time (%v)", pod.Name, err)
+		return fmt.Errorf("pod %s was not removed in time (%w)", pod.Name, err)
+	}
+	return nil
+}
+
+// waitForPodDeletion waits until the pod no longer exists, or has been replaced by a pod with a different UID.
+func waitForPodDeletion(ctx context.Context, cli kubernetes.Interface, pod *core.Pod) error {
+	fieldSelector := fields.
+		OneTermEqualSelector("metadata.name", pod.Name).
+		String()
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options meta.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return cli.CoreV1().Pods(pod.Namespace).List(ctx, options)
+		},
+		WatchFunc: func(options meta.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return cli.CoreV1().Pods(pod.Namespace).Watch(ctx, options)
+		},
+	}
+	isGone := func(currentPod *core.Pod) bool {
+		return currentPod.UID != pod.UID
+	}
+	_, err := watchTools.UntilWithSync(
+		ctx,
+		listWatch,
+		&core.Pod{},
+		func(store cache.Store) (bool, error) {
+			item, exists, err := store.GetByKey(pod.Namespace + "/" + pod.Name)
+			if err != nil {
+				return false, err
+			}
+			return !exists || isGone(item.(*core.Pod)), nil
+		},
+		func(event watch.Event) (bool, error) {
+			if event.Type == watch.Deleted {
+				return true, nil
+			}
+			currentPod, ok := event.Object.(*core.Pod)
+			return ok && isGone(currentPod), nil
+		},
+	)
+	return err
+}
+
+// waitForPendingDeletions waits for pods of the same user that are still being deleted, so their resources are freed
+// before a new pod is created.
+func (n *networkHandler) waitForPendingDeletions(ctx context.Context) error {
+	podList, err := n.cli.CoreV1().Pods(n.config.Pod.Namespace).List(ctx, meta.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{"containerssh_username": n.username}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.DeletionTimestamp == nil {
+			continue
+		}
+		n.logger.Debugf("waiting for pod %s of the same user to be removed", pod.Name)
+		if err := waitForPodDeletion(ctx, n.cli, pod); err != nil {
+			return fmt.Errorf("previous pod %s was not removed in time (%w)", pod.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package kuberun
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDefaultDeleteOptionsShouldCheckUID(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "test", UID: "1234"}}
+
+	options := n.deleteOptions(pod)
+	assert.Nil(t, options.GracePeriodSeconds)
+	assert.Nil(t, options.PropagationPolicy)
+	assert.NotNil(t, options.Preconditions)
+	assert.Equal(t, pod.UID, *options.Preconditions.UID)
+}
+
+func TestDeleteOptionsShouldApplyPolicy(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Delete.GracePeriodSeconds = 0
+	n.config.Delete.PropagationPolicy = meta.DeletePropagationForeground
+	n.config.Delete.CheckUID = false
+	pod := &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "test", UID: "1234"}}
+
+	options := n.deleteOptions(pod)
+	assert.Equal(t, int64(0), *options.GracePeriodSeconds)
+	assert.Equal(t, meta.DeletePropagationForeground, *options.PropagationPolicy)
+	assert.Nil(t, options.Preconditions)
+}
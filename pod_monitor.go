@@ -0,0 +1,124 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerssh/sshserver"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// startPodMonitor starts watching the pod, sending heartbeats and enforcing the connection limits in the background
+// for the lifetime of the connection. The monitor is stopped by OnDisconnect before the pod is removed. The network
+// handler mutex must be held when calling this function.
+func (n *networkHandler) startPodMonitor() {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	n.cancelMonitor = cancelFunc
+	go n.monitorPod(ctx)
+	n.startHeartbeat(ctx)
+	n.startConnectionLimits(ctx, n.pod)
+}
+
+// monitorPod waits for the pod to go away and closes all sessions with the reason once it does.
+func (n *networkHandler) monitorPod(ctx context.Context) {
+	var reason string
+	var exitStatus sshserver.ExitStatus
+	err := n.waitForPodCondition(ctx, func(event watch.Event) (bool, error) {
+		reason, exitStatus = n.podGoneReason(event)
+		return reason != "", nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		n.logger.Warningf("stopped monitoring pod (%v)", err)
+		return
+	}
+	err = fmt.Errorf("the pod for this connection went away: %s", reason)
+	n.hooks.OnPodFailed(n.currentPod(), err)
+	n.closeConnection(ctx, err, exitStatus)
+}
+
+// podGoneReason returns a human-readable reason and an exit status if the event signals that the pod can no longer
+// run sessions. It returns an empty reason if the pod is still healthy. In one-shot mode the console container is
+// expected to terminate and the pod to finish, so this is only reported if the pod was stopped by Kubernetes, e.g.
+// because it was evicted.
+func (n *networkHandler) podGoneReason(event watch.Event) (string, sshserver.ExitStatus) {
+	if event.Type == watch.Deleted {
+		return "the pod was deleted", exitStatusKilled
+	}
+	pod, ok := event.Object.(*core.Pod)
+	if !ok {
+		return "", 0
+	}
+	oneShot := n.config.Pod.OneShot
+	if status := n.consoleContainerStatus(pod); !oneShot && status != nil && status.State.Terminated != nil {
+		terminated := status.State.Terminated
+		exitStatus := exitStatusKilled
+		if terminated.ExitCode > 0 {
+			exitStatus = sshserver.ExitStatus(terminated.ExitCode)
+		}
+		return fmt.Sprintf("the console container terminated (%s)", describeTermination(terminated)), exitStatus
+	}
+	switch pod.Status.Phase {
+	case core.PodFailed, core.PodSucceeded:
+		if oneShot && pod.Status.Reason == "" {
+			break
+		}
+		if pod.Status.Reason == podDeadlineExceededReason {
+			return "the maximum connection duration was reached", exitStatusTimeout
+		}
+		reason := fmt.Sprintf("the pod stopped running (phase %s", pod.Status.Phase)
+		if pod.Status.Reason != "" {
+			reason += fmt.Sprintf(", reason %s", pod.Status.Reason)
+		}
+		if pod.Status.Message != "" {
+			reason += fmt.Sprintf(": %s", pod.Status.Message)
+		}
+		return reason + ")", exitStatusKilled
+	}
+	if pod.DeletionTimestamp != nil {
+		return "the pod is being deleted", exitStatusKilled
+	}
+	return "", 0
+}
+
+// closeConnection records why the connection no longer runs sessions, informs the user in all running sessions and
+// closes them. The programs of the sessions are stopped in the background. The SSH connection itself cannot be closed
+// from here, so new session channels are rejected with the same reason, telling the user to reconnect.
+func (n *networkHandler) closeConnection(ctx context.Context, reason error, exitStatus sshserver.ExitStatus) {
+	n.mutex.Lock()
+	if ctx.Err() != nil || n.closed != nil {
+		n.mutex.Unlock()
+		return
+	}
+	n.closed = reason
+	channels := n.runningChannels()
+	cancelPrograms := make([]func(), 0, len(channels))
+	for _, channel := range channels {
+		if channel.cancelProgram != nil {
+			cancelPrograms = append(cancelPrograms, channel.cancelProgram)
+		}
+	}
+	podName := n.pod.Name
+	n.mutex.Unlock()
+
+	n.logger.Warningf("closing %d sessions on pod %s (%v)", len(channels), podName, reason)
+	for _, cancelProgram := range cancelPrograms {
+		cancelProgram()
+	}
+	for _, channel := range channels {
+		channel.abort(reason.Error()+"; this connection no longer accepts sessions, please reconnect", exitStatus)
+	}
+}
+
+// runningChannels returns the session channels currently running a program. The network handler mutex must be held
+// when calling this function.
+func (n *networkHandler) runningChannels() []*channelHandler {
+	channels := make([]*channelHandler, 0, len(n.channels))
+	for _, channel := range n.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
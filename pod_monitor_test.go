@@ -0,0 +1,96 @@
+package kuberun
+
+import (
+	"testing"
+
+	"github.com/containerssh/sshserver"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestEvictedPodShouldReportReason(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase:   core.PodFailed,
+			Reason:  "Evicted",
+			Message: "The node was low on resource: memory.",
+		},
+	}
+
+	reason, exitStatus := n.podGoneReason(watch.Event{Type: watch.Modified, Object: pod})
+	assert.Contains(t, reason, "Evicted")
+	assert.Contains(t, reason, "low on resource")
+	assert.Equal(t, sshserver.ExitStatus(137), exitStatus)
+}
+
+func TestOOMKilledConsoleContainerShouldReportExitCode(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase: core.PodRunning,
+			ContainerStatuses: []core.ContainerStatus{
+				{
+					Name: "shell",
+					State: core.ContainerState{
+						Terminated: &core.ContainerStateTerminated{
+							ExitCode: 137,
+							Reason:   "OOMKilled",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	reason, exitStatus := n.podGoneReason(watch.Event{Type: watch.Modified, Object: pod})
+	assert.Contains(t, reason, "OOMKilled")
+	assert.Equal(t, sshserver.ExitStatus(137), exitStatus)
+}
+
+func TestHealthyPodShouldNotBeReportedGone(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	pod := &core.Pod{
+		Status: core.PodStatus{
+			Phase: core.PodRunning,
+		},
+	}
+
+	reason, _ := n.podGoneReason(watch.Event{Type: watch.Modified, Object: pod})
+	assert.Equal(t, "", reason)
+}
+
+func TestDeletedPodShouldBeReportedGone(t *testing.T) {
+	n := newTestNetworkHandler(t)
+
+	reason, _ := n.podGoneReason(watch.Event{Type: watch.Deleted, Object: &core.Pod{}})
+	assert.NotEqual(t, "", reason)
+}
+
+func TestFinishedOneShotPodShouldNotBeReportedGone(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.OneShot = true
+	for _, phase := range []core.PodPhase{core.PodSucceeded, core.PodFailed} {
+		pod := &core.Pod{
+			Status: core.PodStatus{
+				Phase: phase,
+				ContainerStatuses: []core.ContainerStatus{
+					{
+						Name: "shell",
+						State: core.ContainerState{
+							Terminated: &core.ContainerStateTerminated{ExitCode: 1},
+						},
+					},
+				},
+			},
+		}
+		reason, _ := n.podGoneReason(watch.Event{Type: watch.Modified, Object: pod})
+		assert.Equal(t, "", reason, phase)
+	}
+
+	pod := &core.Pod{Status: core.PodStatus{Phase: core.PodFailed, Reason: "Evicted"}}
+	reason, exitStatus := n.podGoneReason(watch.Event{Type: watch.Modified, Object: pod})
+	assert.Contains(t, reason, "Evicted")
+	assert.Equal(t, exitStatusKilled, exitStatus)
+}
@@ -0,0 +1,150 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	retainedLabel          = "containerssh_retained"
+	retainUntilAnnotation  = "containerssh.io/retain-until"
+	retainReasonAnnotation = "containerssh.io/retain-reason"
+)
+
+// retentionReason returns why the pod should be kept for debugging, or an empty string if it should be deleted.
+func (n *networkHandler) retentionReason(pod *core.Pod) string {
+	policy := n.config.Retention
+	if policy.Label != "" {
+		if _, ok := pod.Labels[policy.Label]; ok {
+			return fmt.Sprintf("the %s label is set", policy.Label)
+		}
+	}
+	if policy.OnPodFailure && pod.Status.Phase == core.PodFailed {
+		return "the pod failed"
+	}
+	n.mutex.Lock()
+	sessionExited := n.sessionExited
+	lastExitStatus := n.lastExitStatus
+	n.mutex.Unlock()
+	if sessionExited {
+		if policy.OnKilled && lastExitStatus == exitStatusKilled {
+			return fmt.Sprintf("the last session was killed (exit status %d)", lastExitStatus)
+		}
+		if policy.OnNonZeroExit && lastExitStatus != 0 {
+			return fmt.Sprintf("the last session exited with status %d", lastExitStatus)
+		}
+	}
+	return ""
+}
+
+// retainPodIfRequired keeps the pod instead of deleting it if the retention policy requires it. It returns true if
+// the pod has been retained.
+func (n *networkHandler) retainPodIfRequired(ctx context.Context, pod *core.Pod) bool {
+	if n.config.Retention.Duration <= 0 {
+		return false
+	}
+	for {
+		currentPod, err := n.cli.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, meta.GetOptions{})
+		if err != nil || currentPod.UID != pod.UID {
+			return false
+		}
+		reason := n.retentionReason(currentPod)
+		if reason == "" {
+			return false
+		}
+		retainUntil := time.Now().Add(n.config.Retention.Duration).UTC()
+		if currentPod.Labels == nil {
+			currentPod.Labels = map[string]string{}
+		}
+		if currentPod.Annotations == nil {
+			currentPod.Annotations = map[string]string{}
+		}
+		currentPod.Labels[retainedLabel] = "true"
+		currentPod.Annotations[retainUntilAnnotation] = retainUntil.Format(time.RFC3339)
+		currentPod.Annotations[retainReasonAnnotation] = reason
+		_, err = n.cli.CoreV1().Pods(pod.Namespace).Update(ctx, currentPod, meta.UpdateOptions{})
+		if err == nil {
+			n.logger.Noticef("retaining pod %s until %s because %s", pod.Name, retainUntil.Format(time.RFC3339), reason)
+			return true
+		}
+		if !errors.IsConflict(err) {
+			n.logger.Warningf("failed to retain pod %s, removing it (%v)", pod.Name, err)
+			return false
+		}
+	}
+}
+
+// Reaper removes pods that were retained for debugging once their retention period has expired.
+type Reaper interface {
+	// Run removes expired pods periodically until the context is cancelled.
+	Run(ctx context.Context)
+}
+
+// NewReaper creates a reaper for the retained pods in the namespace of the pod configuration.
+func NewReaper(config Config, logger log.Logger) (Reaper, error) {
+	connectionConfig := CreateConnectionConfig(config)
+	cli, err := kubernetes.NewForConfig(&connectionConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &reaper{
+		config: config,
+		cli:    cli,
+		logger: logger,
+	}, nil
+}
+
+type reaper struct {
+	config Config
+	cli    kubernetes.Interface
+	logger log.Logger
+}
+
+func (r *reaper) Run(ctx context.Context) {
+	for {
+		if err := reapRetainedPods(ctx, r.cli, r.config.Pod.Namespace, r.logger); err != nil && ctx.Err() == nil {
+			r.logger.Warningf("failed to remove expired retained pods (%v)", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.config.Retention.ReapInterval):
+		}
+	}
+}
+
+// reapRetainedPods removes all retained pods in the namespace whose retention period has expired.
+func reapRetainedPods(ctx context.Context, cli kubernetes.Interface, namespace string, logger log.Logger) error {
+	podList, err := cli.CoreV1().Pods(namespace).List(ctx, meta.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{retainedLabel: "true"}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, pod := range podList.Items {
+		retainUntil, err := time.Parse(time.RFC3339, pod.Annotations[retainUntilAnnotation])
+		if err != nil {
+			logger.Warningf("retained pod %s has an invalid %s annotation, removing it", pod.Name, retainUntilAnnotation)
+		} else if time.Now().Before(retainUntil) {
+			continue
+		}
+		uid := pod.UID
+		err = cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{UID: &uid},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			logger.Warningf("failed to remove retained pod %s (%v)", pod.Name, err)
+			continue
+		}
+		logger.Debugf("removed retained pod %s", pod.Name)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package kuberun
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRetentionReason(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	running := &core.Pod{Status: core.PodStatus{Phase: core.PodRunning}}
+
+	assert.Equal(t, "", n.retentionReason(running))
+
+	n.sessionExited = true
+	n.lastExitStatus = 137
+	assert.NotEqual(t, "", n.retentionReason(running))
+
+	n.lastExitStatus = 1
+	assert.Equal(t, "", n.retentionReason(running))
+	n.config.Retention.OnNonZeroExit = true
+	assert.NotEqual(t, "", n.retentionReason(running))
+
+	n.lastExitStatus = 0
+	assert.NotEqual(t, "", n.retentionReason(&core.Pod{Status: core.PodStatus{Phase: core.PodFailed}}))
+	assert.NotEqual(t, "", n.retentionReason(&core.Pod{
+		ObjectMeta: meta.ObjectMeta{Labels: map[string]string{"containerssh.io/retain": "true"}},
+		Status:     core.PodStatus{Phase: core.PodRunning},
+	}))
+}
+
+func TestReaperShouldOnlyRemoveExpiredPods(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	newPod := func(name string, retainUntil time.Time) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{retainedLabel: "true"},
+				Annotations: map[string]string{retainUntilAnnotation: retainUntil.Format(time.RFC3339)},
+			},
+		}
+	}
+	cli := fake.NewSimpleClientset(
+		newPod("expired", time.Now().Add(-time.Minute)),
+		newPod("retained", time.Now().Add(time.Hour)),
+	)
+
+	assert.NoError(t, reapRetainedPods(context.Background(), cli, "default", n.logger))
+
+	podList, err := cli.CoreV1().Pods("default").List(context.Background(), meta.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(podList.Items))
+	assert.Equal(t, "retained", podList.Items[0].Name)
+}
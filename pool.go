@@ -0,0 +1,327 @@
+package kuberun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerssh/log"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+)
+
+const (
+	poolLabel          = "containerssh_pool"
+	poolStateLabel     = "containerssh_pool_state"
+	poolStateAvailable = "available"
+	poolStateClaimed   = "claimed"
+)
+
+// pools contains the warm pools running in this process, keyed by the pool key of the profile.
+var pools = map[string]*warmPool{}
+var poolsMutex = &sync.Mutex{}
+
+// WarmPool keeps a number of ready, unassigned pods for a single profile, so connections do not have to wait for a new
+// pod to start.
+type WarmPool interface {
+	// Run maintains the pool until the context is cancelled. When the context is cancelled, the unassigned pods
+	// created by this instance are removed.
+	Run(ctx context.Context)
+}
+
+// NewWarmPool creates the warm pool for the profile in the config. It should be run when the server starts, for each
+// profile with a pool size configured. Connections claim pods created by the pools of any replica, but only trigger
+// refills of a pool running in the same process.
+func NewWarmPool(config Config, logger log.Logger) (WarmPool, error) {
+	if config.Pool.Size <= 0 {
+		return nil, fmt.Errorf("the warm pool requires Pool.Size to be set")
+	}
+	if config.Pod.OneShot {
+		return nil, fmt.Errorf("the warm pool cannot be used with one-shot pods")
+	}
+	key, err := poolKey(config)
+	if err != nil {
+		return nil, err
+	}
+	connectionConfig := CreateConnectionConfig(config)
+	cli, err := kubernetes.NewForConfig(&connectionConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &warmPool{
+		key:              key,
+		config:           config,
+		cli:              cli,
+		restClientConfig: connectionConfig,
+		logger:           logger,
+		instance:         instanceID(config),
+		refill:           make(chan struct{}, 1),
+	}, nil
+}
+
+type warmPool struct {
+	key              string
+	config           Config
+	cli              kubernetes.Interface
+	restClientConfig restclient.Config
+	logger           log.Logger
+	instance         string
+	refill           chan struct{}
+}
+
+// triggerPoolRefill asks the pool for the key to replace claimed pods without waiting for the next refill interval, if
+// the pool runs in this process.
+func triggerPoolRefill(key string) {
+	poolsMutex.Lock()
+	pool, ok := pools[key]
+	poolsMutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case pool.refill <- struct{}{}:
+	default:
+	}
+}
+
+// poolKey returns a label-safe key identifying the profile name and the pod configuration. Profiles with different
+// pod configurations never share pods.
+func poolKey(config Config) (string, error) {
+	podConfig, err := json.Marshal(config.Pod)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal pod configuration (%w)", err)
+	}
+	hash := sha256.New()
+	hash.Write([]byte(config.Profile))
+	hash.Write([]byte{0})
+	hash.Write(podConfig)
+	return hex.EncodeToString(hash.Sum(nil))[:32], nil
+}
+
+func (p *warmPool) Run(ctx context.Context) {
+	poolsMutex.Lock()
+	if _, ok := pools[p.key]; ok {
+		poolsMutex.Unlock()
+		p.logger.Warningf("warm pool %s is already running", p.key)
+		return
+	}
+	pools[p.key] = p
+	poolsMutex.Unlock()
+	defer func() {
+		poolsMutex.Lock()
+		delete(pools, p.key)
+		poolsMutex.Unlock()
+	}()
+
+	interval := p.config.Pool.RefillInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		maintainContext, cancelFunc := context.WithTimeout(ctx, p.config.Timeout)
+		if err := p.maintain(maintainContext); err != nil && ctx.Err() == nil {
+			p.logger.Warningf("failed to maintain warm pool %s (%v)", p.key, err)
+		}
+		cancelFunc()
+		select {
+		case <-ctx.Done():
+			p.drain()
+			return
+		case <-p.refill:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// drain removes the unassigned pods created by this instance. Pods claimed in the meantime are kept, since their
+// resourceVersion changed.
+func (p *warmPool) drain() {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancelFunc()
+	pods, err := listPoolPods(ctx, p.cli, p.config.Pod.Namespace, p.key)
+	if err != nil {
+		p.logger.Warningf("failed to remove pods of warm pool %s (%v)", p.key, err)
+		return
+	}
+	for _, pod := range pods {
+		if pod.Annotations[instanceAnnotation] != p.instance || pod.DeletionTimestamp != nil {
+			continue
+		}
+		uid := pod.UID
+		err := p.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{UID: &uid, ResourceVersion: &pod.ResourceVersion},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			p.logger.Warningf("failed to remove pod %s from warm pool %s (%v)", pod.Name, p.key, err)
+		}
+	}
+}
+
+// listPoolPods returns the unassigned pods of the pool with the key, oldest first.
+func listPoolPods(ctx context.Context, cli kubernetes.Interface, namespace string, key string) ([]core.Pod, error) {
+	podList, err := cli.CoreV1().Pods(namespace).List(ctx, meta.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			poolLabel:      key,
+			poolStateLabel: poolStateAvailable,
+		}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+	return pods, nil
+}
+
+// maintain removes expired or failed pods from the pool and creates new ones until the configured size is reached. If
+// the garbage collector is enabled, the heartbeat of the remaining pods is refreshed, so the collector removes the pods
+// once no replica maintains the pool.
+func (p *warmPool) maintain(ctx context.Context) error {
+	pods, err := listPoolPods(ctx, p.cli, p.config.Pod.Namespace, p.key)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, pod := range pods {
+		expired := p.config.Pool.MaxIdleAge > 0 && time.Since(pod.CreationTimestamp.Time) > p.config.Pool.MaxIdleAge
+		failed := pod.Status.Phase == core.PodFailed || pod.Status.Phase == core.PodSucceeded
+		if !expired && !failed && pod.DeletionTimestamp == nil {
+			count++
+			p.refreshHeartbeat(ctx, &pod)
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		p.logger.Debugf("removing pod %s from warm pool %s (expired: %t, failed: %t)", pod.Name, p.key, expired, failed)
+		uid := pod.UID
+		err := p.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{UID: &uid, ResourceVersion: &pod.ResourceVersion},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			p.logger.Warningf("failed to remove pod %s from warm pool %s (%v)", pod.Name, p.key, err)
+		}
+	}
+
+	if count >= p.config.Pool.Size {
+		return nil
+	}
+	ownerReferences, err := resolvePoolOwnerReferences(ctx, p.config, p.cli, p.restClientConfig)
+	if err != nil {
+		return fmt.Errorf("failed to resolve owner of pool pods (%w)", err)
+	}
+	for ; count < p.config.Pool.Size; count++ {
+		if _, err := p.cli.CoreV1().Pods(p.config.Pod.Namespace).Create(
+			ctx,
+			&core.Pod{
+				ObjectMeta: meta.ObjectMeta{
+					GenerateName: "containerssh-pool-",
+					Namespace:    p.config.Pod.Namespace,
+					Labels: map[string]string{
+						poolLabel:      p.key,
+						poolStateLabel: poolStateAvailable,
+					},
+					Annotations: map[string]string{
+						instanceAnnotation:  p.instance,
+						heartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+					},
+					OwnerReferences: ownerReferences,
+				},
+				Spec: *createPodSpec(p.config),
+			},
+			meta.CreateOptions{},
+		); err != nil {
+			return fmt.Errorf("failed to create pod (%w)", err)
+		}
+	}
+	return nil
+}
+
+// refreshHeartbeat updates the heartbeat of an unassigned pod if the garbage collector is enabled and the heartbeat is
+// older than the heartbeat interval.
+func (p *warmPool) refreshHeartbeat(ctx context.Context, pod *core.Pod) {
+	if !p.config.GC.Enable {
+		return
+	}
+	heartbeat, err := time.Parse(time.RFC3339, pod.Annotations[heartbeatAnnotation])
+	if err == nil && time.Since(heartbeat) < p.config.GC.HeartbeatInterval {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				heartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	if _, err := p.cli.CoreV1().Pods(pod.Namespace).Patch(
+		ctx,
+		pod.Name,
+		types.MergePatchType,
+		patch,
+		meta.PatchOptions{},
+	); err != nil && !errors.IsNotFound(err) {
+		p.logger.Debugf("failed to refresh heartbeat of pod %s in warm pool %s (%v)", pod.Name, p.key, err)
+	}
+}
+
+// claimPoolPod assigns a ready pod from the pool with the key to a connection by adding the labels and annotations of
+// the connection and replacing the owner references with those of the connection. The update carries the
+// resourceVersion of the listed pod, so only one connection, on any replica, can claim a given pod. It returns nil if
+// no ready pod is available.
+func claimPoolPod(
+	ctx context.Context,
+	cli kubernetes.Interface,
+	config Config,
+	key string,
+	connectionMeta meta.ObjectMeta,
+) (*core.Pod, error) {
+	pods, err := listPoolPods(ctx, cli, config.Pod.Namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	defer triggerPoolRefill(key)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || !isPodReady(&pod) {
+			continue
+		}
+		claimedPod := pod.DeepCopy()
+		claimedPod.Labels[poolStateLabel] = poolStateClaimed
+		for key, value := range connectionMeta.Labels {
+			claimedPod.Labels[key] = value
+		}
+		if claimedPod.Annotations == nil && len(connectionMeta.Annotations) > 0 {
+			claimedPod.Annotations = map[string]string{}
+		}
+		for key, value := range connectionMeta.Annotations {
+			claimedPod.Annotations[key] = value
+		}
+		claimedPod.OwnerReferences = connectionMeta.OwnerReferences
+		claimedPod.Spec.ActiveDeadlineSeconds = activeDeadlineSeconds(config, pod.Status.StartTime)
+		updatedPod, err := cli.CoreV1().Pods(pod.Namespace).Update(ctx, claimedPod, meta.UpdateOptions{})
+		if err != nil {
+			if errors.IsConflict(err) || errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		return updatedPod, nil
+	}
+	return nil, nil
+}
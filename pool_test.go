@@ -0,0 +1,119 @@
+package kuberun
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerssh/structutils"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPoolKeyShouldDifferPerProfile(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+
+	config.Profile = "a"
+	keyA, err := poolKey(config)
+	assert.NoError(t, err)
+	config.Profile = "b"
+	keyB, err := poolKey(config)
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, keyA, keyB)
+	assert.LessOrEqual(t, len(keyA), 63)
+}
+
+func TestPoolClaimShouldRelabelReadyPod(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	key, err := poolKey(config)
+	assert.NoError(t, err)
+
+	newPod := func(name string, ready core.ConditionStatus) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      name,
+				Namespace: config.Pod.Namespace,
+				Labels: map[string]string{
+					poolLabel:      key,
+					poolStateLabel: poolStateAvailable,
+				},
+			},
+			Status: core.PodStatus{
+				Phase:      core.PodRunning,
+				Conditions: []core.PodCondition{{Type: core.PodReady, Status: ready}},
+			},
+		}
+	}
+	cli := fake.NewSimpleClientset(newPod("not-ready", core.ConditionFalse), newPod("ready", core.ConditionTrue))
+	pod, err := claimPoolPod(context.Background(), cli, config, key, meta.ObjectMeta{
+		Labels: map[string]string{"containerssh_username": "test"},
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, pod)
+	assert.Equal(t, "ready", pod.Name)
+	assert.Equal(t, poolStateClaimed, pod.Labels[poolStateLabel])
+	assert.Equal(t, "test", pod.Labels["containerssh_username"])
+
+	pod, err = claimPoolPod(context.Background(), cli, config, key, meta.ObjectMeta{
+		Labels: map[string]string{"containerssh_username": "test"},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, pod)
+}
+
+func TestPoolShouldOnlyDrainOwnPods(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	key, err := poolKey(config)
+	assert.NoError(t, err)
+
+	newPod := func(name string, instance string) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        name,
+				Namespace:   config.Pod.Namespace,
+				Labels:      map[string]string{poolLabel: key, poolStateLabel: poolStateAvailable},
+				Annotations: map[string]string{instanceAnnotation: instance},
+			},
+		}
+	}
+	cli := fake.NewSimpleClientset(newPod("own", "containerssh-0"), newPod("other", "containerssh-1"))
+	pool := &warmPool{key: key, config: config, cli: cli, logger: newTestNetworkHandler(t).logger, instance: "containerssh-0"}
+
+	pool.drain()
+	pods, err := listPoolPods(context.Background(), cli, config.Pod.Namespace, key)
+	assert.NoError(t, err)
+	assert.Len(t, pods, 1)
+	assert.Equal(t, "other", pods[0].Name)
+}
+
+func TestUnmaintainedPoolPodShouldBeCollected(t *testing.T) {
+	config := Config{}
+	structutils.Defaults(&config)
+	config.GC.Enable = true
+
+	newPod := func(name string, heartbeat time.Time) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:              name,
+				Namespace:         config.Pod.Namespace,
+				CreationTimestamp: meta.NewTime(time.Now().Add(-time.Hour)),
+				Labels:            map[string]string{poolLabel: "test", poolStateLabel: poolStateAvailable},
+				Annotations:       map[string]string{heartbeatAnnotation: heartbeat.UTC().Format(time.RFC3339)},
+			},
+		}
+	}
+	cli := fake.NewSimpleClientset(newPod("maintained", time.Now()), newPod("unmaintained", time.Now().Add(-time.Hour)))
+	g := &garbageCollector{config: config, cli: cli, logger: newTestNetworkHandler(t).logger}
+
+	assert.NoError(t, g.collect(context.Background()))
+	pods, err := listPoolPods(context.Background(), cli, config.Pod.Namespace, "test")
+	assert.NoError(t, err)
+	assert.Len(t, pods, 1)
+	assert.Equal(t, "maintained", pods[0].Name)
+}
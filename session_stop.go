@@ -0,0 +1,173 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// errorCancelingWriter cancels the context of the channel when writing to the client fails, e.g. because the client
+// closed the channel, so the program does not keep running without anyone reading its output.
+type errorCancelingWriter struct {
+	writer io.Writer
+	cancel func()
+}
+
+func (w *errorCancelingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err != nil {
+		w.cancel()
+	}
+	return n, err
+}
+
+// channelProbeInterval is how often a channel is probed after the client sent EOF on stdin.
+const channelProbeInterval = 5 * time.Second
+
+// channelRequester is implemented by the SSH channels passed as stdin.
+type channelRequester interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, error)
+}
+
+// eofWatchingReader calls onEOF once when reading returns an error, e.g. because the client sent EOF or closed the
+// channel.
+type eofWatchingReader struct {
+	reader io.Reader
+	once   sync.Once
+	onEOF  func()
+}
+
+func (r *eofWatchingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil {
+		r.once.Do(r.onEOF)
+	}
+	return n, err
+}
+
+// watchChannelClose cancels the context of the channel once the client has closed the channel. A closed channel
+// cannot be told apart from EOF on stdin by reading, so after EOF the channel is probed with a keepalive request that
+// clients ignore, which fails once the channel is closed. Without this, a program that writes no output would keep
+// running after the client went away.
+func (c *channelHandler) watchChannelClose(ctx context.Context, channel channelRequester, cancel func()) {
+	ticker := time.NewTicker(channelProbeInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := channel.SendRequest("keepalive@openssh.com", false, nil); err != nil {
+			c.networkHandler.logger.Debugf("channel %d was closed by the client (%v)", c.channelID, err)
+			cancel()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopProgram stops the program running in the channel after its context was cancelled. The stdin of the program is
+// closed first, then it is sent SIGTERM and SIGKILL, waiting for the stream to end after each step. It returns the
+// result of the stream, or an error if the program did not stop in time.
+func (c *channelHandler) stopProgram(stdin io.Closer, done <-chan error) error {
+	n := c.networkHandler
+	config := n.config.SessionStop
+	n.logger.Debugf("stopping program in channel %d", c.channelID)
+
+	_ = stdin.Close()
+	if stopped, err := waitForStream(done, config.StdinTimeout); stopped {
+		return err
+	}
+	for _, step := range []struct {
+		signal  string
+		timeout time.Duration
+	}{
+		{"TERM", config.TerminateTimeout},
+		{"KILL", config.KillTimeout},
+	} {
+		if n.config.Pod.Signals.Enable {
+			ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+			_ = c.signalProgram(ctx, step.signal)
+			cancel()
+		}
+		if stopped, err := waitForStream(done, step.timeout); stopped {
+			return err
+		}
+	}
+	n.logger.Warningf("the program in channel %d did not stop, abandoning it", c.channelID)
+	return fmt.Errorf("the program did not stop")
+}
+
+// waitForStream waits for the stream to end for at most the timeout and returns its result. The first return value is
+// false on timeout.
+func waitForStream(done <-chan error, timeout time.Duration) (bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return true, err
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+// drainChannels waits for the programs of all channels to stop after the connection context was cancelled, so the
+// pod is not removed under running streams.
+func (n *networkHandler) drainChannels() {
+	n.mutex.Lock()
+	handlers := make([]func(), 0, len(n.onDisconnect))
+	for _, handler := range n.onDisconnect {
+		handlers = append(handlers, handler)
+	}
+	n.mutex.Unlock()
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+// OnShutdown stops the programs of all channels when the server shuts down and waits for them until the shutdown
+// context expires. The pod is removed in OnDisconnect when the server closes the connection.
+func (n *networkHandler) OnShutdown(shutdownContext context.Context) {
+	n.cancelConnection()
+	n.mutex.Lock()
+	handlers := make([]func(shutdownContext context.Context), 0, len(n.onShutdown))
+	for _, handler := range n.onShutdown {
+		handlers = append(handlers, handler)
+	}
+	n.mutex.Unlock()
+	wg := &sync.WaitGroup{}
+	for _, handler := range handlers {
+		wg.Add(1)
+		go func(handler func(shutdownContext context.Context)) {
+			defer wg.Done()
+			handler(shutdownContext)
+		}(handler)
+	}
+	wg.Wait()
+}
+
+// registerChannelStop records the handlers that wait for the program of the channel to stop on disconnect and
+// shutdown. It must be called with the network handler mutex held. The returned function removes the handlers and
+// must be called when the program has stopped.
+func (c *channelHandler) registerChannelStop() func() {
+	n := c.networkHandler
+	drained := make(chan struct{})
+	n.onDisconnect[c.channelID] = func() {
+		<-drained
+	}
+	n.onShutdown[c.channelID] = func(shutdownContext context.Context) {
+		select {
+		case <-drained:
+		case <-shutdownContext.Done():
+		}
+	}
+	return func() {
+		n.mutex.Lock()
+		delete(n.onDisconnect, c.channelID)
+		delete(n.onShutdown, c.channelID)
+		n.mutex.Unlock()
+		close(drained)
+	}
+}
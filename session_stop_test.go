@@ -0,0 +1,107 @@
+package kuberun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct{}
+
+func (f *failingWriter) Write(_ []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func TestFailedChannelWriteShouldCancelChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := &errorCancelingWriter{writer: &failingWriter{}, cancel: cancel}
+	_, err := writer.Write([]byte("Hello world!"))
+	assert.Error(t, err)
+	assert.Error(t, ctx.Err())
+}
+
+func TestStopProgramShouldCloseStdinFirst(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.Signals.Enable = false
+	c := newTestChannelHandler(n)
+
+	stdinReader, stdinWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, stdinReader)
+		done <- fmt.Errorf("stdin closed")
+	}()
+	assert.EqualError(t, c.stopProgram(stdinWriter, done), "stdin closed")
+}
+
+func TestStopProgramShouldGiveUpOnStuckPrograms(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.Signals.Enable = false
+	n.config.SessionStop = SessionStopConfig{
+		StdinTimeout:     10 * time.Millisecond,
+		TerminateTimeout: 10 * time.Millisecond,
+		KillTimeout:      10 * time.Millisecond,
+	}
+	c := newTestChannelHandler(n)
+
+	_, stdinWriter := io.Pipe()
+	assert.Error(t, c.stopProgram(stdinWriter, make(chan error)))
+}
+
+func TestDisconnectAndShutdownShouldWaitForChannels(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	c := newTestChannelHandler(n)
+	c.channelID = 1
+
+	n.mutex.Lock()
+	drained := c.registerChannelStop()
+	n.mutex.Unlock()
+
+	shutdownContext, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	n.OnShutdown(shutdownContext)
+	assert.Error(t, n.connectionContext.Err())
+	assert.Error(t, shutdownContext.Err())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		drained()
+	}()
+	n.drainChannels()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	assert.Empty(t, n.onDisconnect)
+	assert.Empty(t, n.onShutdown)
+}
+
+type closedChannel struct{}
+
+func (c *closedChannel) SendRequest(_ string, _ bool, _ []byte) (bool, error) {
+	return false, io.EOF
+}
+
+func TestClosedChannelShouldCancelChannelAfterEOF(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	c := newTestChannelHandler(n)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := &eofWatchingReader{reader: bytes.NewReader(nil), onEOF: func() {
+		go c.watchChannelClose(ctx, &closedChannel{}, cancel)
+	}}
+	_, err := reader.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the closed channel was not detected")
+	}
+}
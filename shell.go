@@ -0,0 +1,146 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// execShellPasswd is the ExecShell value that selects the login shell of the container user from /etc/passwd.
+const execShellPasswd = "passwd"
+
+// loginShellScript prints the UID passed as an argument, or the UID of the container user if there is none, followed
+// by the passwd database.
+const loginShellScript = `echo "${1:-$(id -u)}" && cat /etc/passwd`
+
+// execShell returns the shell running the commands of exec requests. If the shell is read from /etc/passwd, this
+// waits for the pod to start and the result is cached for the connection. The login shell of the mapped user takes
+// precedence over the one of the container user.
+func (n *networkHandler) execShell() (string, error) {
+	if n.config.Pod.ExecShell != execShellPasswd {
+		return n.config.Pod.ExecShell, nil
+	}
+	return n.loginShell()
+}
+
+// loginShell returns the login shell of the mapped user, or of the container user if the user is not mapped, from
+// /etc/passwd in the console container.
+func (n *networkHandler) loginShell() (string, error) {
+	if err := n.waitForPodStart(); err != nil {
+		return "", fmt.Errorf("failed to start the pod for this connection (%w)", err)
+	}
+	if shell := n.mappedShell(); shell != "" {
+		return shell, nil
+	}
+	command := []string{n.config.Pod.HelperShell, "-c", loginShellScript, "login-shell"}
+	if n.mappedUser != nil {
+		command = append(command, strconv.FormatInt(n.mappedUser.UID, 10))
+	}
+	n.mutex.Lock()
+	shell := n.loginShellPath
+	n.mutex.Unlock()
+	if shell != "" {
+		return shell, nil
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeout)
+	defer cancelFunc()
+	result, err := n.execPodCommand(ctx, n.currentPod(), PodCommand{Command: command})
+	if err != nil {
+		return "", fmt.Errorf("failed to read /etc/passwd in the container (%w)", err)
+	}
+	shell, err = parseLoginShell(result.output)
+	if err != nil {
+		return "", err
+	}
+	n.logger.Debugf("detected login shell %s", shell)
+
+	n.mutex.Lock()
+	n.loginShellPath = shell
+	n.mutex.Unlock()
+	return shell, nil
+}
+
+// shellProbeScript prints the path of the first shell passed as an argument that is available in the container.
+const shellProbeScript = `for shell in "$@"; do command -v "$shell" && exit 0; done; exit 1`
+
+// probeShell looks for the first available shell from the auto shell candidates in the console container and stores
+// the result for the shell requests of the connection.
+func (n *networkHandler) probeShell(ctx context.Context) {
+	if !n.config.Pod.AutoShell.Enable || n.config.Pod.OneShot {
+		return
+	}
+	shell, err := n.findShell(ctx)
+	if err != nil {
+		n.logger.Warningf("no shell found in the console container (%v)", err)
+	} else {
+		n.logger.Debugf("detected shell %s", shell)
+	}
+	n.mutex.Lock()
+	n.autoShellPath = shell
+	n.autoShellError = err
+	n.mutex.Unlock()
+}
+
+func (n *networkHandler) findShell(ctx context.Context) (string, error) {
+	candidates := n.config.Pod.AutoShell.Candidates
+	command := append([]string{n.config.Pod.HelperShell, "-c", shellProbeScript, "probe"}, candidates...)
+	result, err := n.execPodCommand(ctx, n.currentPod(), PodCommand{Command: command})
+	if err != nil {
+		return "", fmt.Errorf("none of %s is available (%v)", strings.Join(candidates, ", "), err)
+	}
+	shell := strings.TrimSpace(result.output)
+	if !strings.HasPrefix(shell, "/") {
+		return "", fmt.Errorf(
+			"none of %s is available (unexpected probe output: %q)",
+			strings.Join(candidates, ", "),
+			shell,
+		)
+	}
+	return shell, nil
+}
+
+// shellProgram returns the program to run for shell requests. The shell of the mapped user takes precedence. With auto
+// shell detection this waits for the pod to start and returns an error if no shell was found.
+func (n *networkHandler) shellProgram() ([]string, error) {
+	if n.config.UserMapping.Mode != UserMappingModeNone {
+		if err := n.waitForPodStart(); err != nil {
+			return nil, fmt.Errorf("failed to start the pod for this connection: %v", err)
+		}
+		if shell := n.mappedShell(); shell != "" {
+			return []string{shell}, nil
+		}
+	}
+	if !n.config.Pod.AutoShell.Enable {
+		return n.config.Pod.ShellCommand, nil
+	}
+	if err := n.waitForPodStart(); err != nil {
+		return nil, fmt.Errorf("failed to start the pod for this connection: %v", err)
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.autoShellError != nil {
+		return nil, fmt.Errorf(
+			"no shell is available in this container, looked for %s",
+			strings.Join(n.config.Pod.AutoShell.Candidates, ", "),
+		)
+	}
+	return []string{n.autoShellPath}, nil
+}
+
+// parseLoginShell finds the shell of the user in the output of loginShellScript.
+func parseLoginShell(output string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	uid := strings.TrimSpace(lines[0])
+	for _, line := range lines[1:] {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) == 7 && fields[2] == uid {
+			if fields[6] == "" {
+				return "/bin/sh", nil
+			}
+			return fields[6], nil
+		}
+	}
+	return "", fmt.Errorf("the user with UID %s has no entry in /etc/passwd", uid)
+}
@@ -0,0 +1,116 @@
+package kuberun
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/containerssh/sshserver"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestAutoExecModeShouldKeepCurrentBehavior(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	c := newTestChannelHandler(n)
+
+	for command, expected := range map[string][]string{
+		`/bin/echo "Hello world!"`:   {"/bin/echo", "Hello world!"},
+		`./run.sh 'a b' c\ d`:        {"./run.sh", "a b", "c d"},
+		`../bin/tool --x="y z"`:      {"../bin/tool", "--x=y z"},
+		`echo "Hello world!"`:        {"/bin/sh", "-c", `echo "Hello world!"`},
+		`/bin/echo foo; rm -rf /tmp`: {"/bin/echo", "foo"},
+		`/bin/echo foo | wc -c`:      {"/bin/echo", "foo"},
+		`/bin/echo 'unterminated`:    {"/bin/sh", "-c", `/bin/echo 'unterminated`},
+		`/bin/echo $HOME`:            {"/bin/echo", "$HOME"},
+		``:                           {"/bin/sh", "-c", ``},
+	} {
+		program, err := c.parseProgram(command)
+		assert.NoError(t, err, command)
+		assert.Equal(t, expected, program, command)
+	}
+}
+
+func TestExecModesShouldWrapCommands(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.ExecShell = "/bin/ash"
+	c := newTestChannelHandler(n)
+
+	n.config.Pod.ExecMode = ExecModeShell
+	program, err := c.parseProgram(`/bin/ls "a b"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/ash", "-c", `/bin/ls "a b"`}, program)
+
+	n.config.Pod.ExecMode = ExecModeLogin
+	program, err = c.parseProgram(`ls`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/ash", "-lc", `ls`}, program)
+
+	n.config.Pod.ExecMode = ExecModeArgv
+	program, err = c.parseProgram(`ls -l "a b" 'it''s'`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ls", "-l", "a b", "its"}, program)
+	_, err = c.parseProgram(`ls > /tmp/out`)
+	assert.Error(t, err)
+}
+
+func TestLoginShellShouldBeReadFromPasswd(t *testing.T) {
+	shell, err := parseLoginShell("1000\nroot:x:0:0:root:/root:/bin/bash\nuser:x:1000:1000::/home/user:/bin/zsh\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "/bin/zsh", shell)
+
+	shell, err = parseLoginShell("0\nroot:x:0:0:root:/root:\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "/bin/sh", shell)
+
+	_, err = parseLoginShell("1234\nroot:x:0:0:root:/root:/bin/ash\n")
+	assert.Error(t, err)
+}
+
+func TestLoginShellShouldBeReadForMappedUser(t *testing.T) {
+	n, _, calls := newCommandTestNetworkHandler(t, map[string]func(options remotecommand.StreamOptions) error{
+		"/bin/sh": func(options remotecommand.StreamOptions) error {
+			_, err := options.Stdout.Write([]byte(
+				"1000\nroot:x:0:0:root:/root:/bin/bash\nuser:x:1000:1000::/home/user:/bin/zsh\n",
+			))
+			return err
+		},
+	})
+	n.config.Pod.ExecShell = execShellPasswd
+	n.mappedUser = &MappedUser{UID: 1000, GID: 1000}
+
+	shell, err := n.execShell()
+	assert.NoError(t, err)
+	assert.Equal(t, "/bin/zsh", shell)
+	assert.Equal(t, []string{"/bin/sh -c " + loginShellScript + " login-shell 1000"}, calls.get())
+}
+
+func TestMissingAutoShellShouldFailSessionWithMessage(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.AutoShell.Enable = true
+	n.ready = make(chan struct{})
+	close(n.ready)
+	n.autoShellError = fmt.Errorf("none of bash, zsh, ash, sh is available")
+	c := newTestChannelHandler(n)
+
+	stderr := &bytes.Buffer{}
+	exitStatuses := make(chan sshserver.ExitStatus, 1)
+	err := c.OnShell(0, &bytes.Buffer{}, &bytes.Buffer{}, stderr, func(exitStatus sshserver.ExitStatus) {
+		exitStatuses <- exitStatus
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, n.config.ExitStatus.SetupFailure, <-exitStatuses)
+	assert.Contains(t, stderr.String(), "no shell is available")
+}
+
+func TestAutoShellShouldUseDetectedShell(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.AutoShell.Enable = true
+	n.ready = make(chan struct{})
+	close(n.ready)
+	n.autoShellPath = "/bin/ash"
+
+	program, err := n.shellProgram()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/ash"}, program)
+}
@@ -0,0 +1,106 @@
+package kuberun
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// signalLauncherScript records the PID of the program in the file passed as $0 and replaces itself with the program,
+// so the PID stays the same. The directory of the file is created private to the user running the launcher, and
+// refused if it is a symlink or belongs to someone else, so other users cannot plant or replace PID files.
+const signalLauncherScript = `d="${0%/*}"; umask 077; { [ -d "$d" ] || mkdir -p "$d"; } && ` +
+	`[ ! -L "$d" ] && [ -O "$d" ] && chmod 700 "$d" && echo $$ > "$0" && exec "$@"; ` +
+	`echo "cannot use PID directory $d" >&2; exit 126`
+
+// signalKillScript sends the signal passed as $0 to the PID recorded in the file passed as $1. The file and its
+// directory must belong to the user running the script and must not be symlinks.
+const signalKillScript = `d="${1%/*}"; [ ! -L "$d" ] && [ -O "$d" ] && [ ! -L "$1" ] && [ -O "$1" ] && ` +
+	`pid="$(cat "$1")" && case "$pid" in ''|*[!0-9]*) exit 1;; esac && kill -s "$0" "$pid"`
+
+// signalNumbers maps the signal names defined in RFC 4254 section 6.10 to their numbers on Linux.
+var signalNumbers = map[string]int{
+	"ABRT": 6,
+	"ALRM": 14,
+	"FPE":  8,
+	"HUP":  1,
+	"ILL":  4,
+	"INT":  2,
+	"KILL": 9,
+	"PIPE": 13,
+	"QUIT": 3,
+	"SEGV": 11,
+	"TERM": 15,
+	"USR1": 10,
+	"USR2": 12,
+}
+
+// signalPIDFile returns the path of the file in the pod containing the PID of the program running in the channel.
+func (c *channelHandler) signalPIDFile() string {
+	return path.Join(
+		c.networkHandler.config.Pod.Signals.PIDDirectory,
+		"containerssh-"+c.networkHandler.connectionID+"-"+strconv.FormatUint(c.channelID, 10)+".pid",
+	)
+}
+
+// wrapSignalLauncher prefixes the program with the launcher recording its PID if signals are enabled.
+func (c *channelHandler) wrapSignalLauncher(program []string) []string {
+	signals := c.networkHandler.config.Pod.Signals
+	if !signals.Enable {
+		return program
+	}
+	return append([]string{signals.Shell, "-c", signalLauncherScript, c.signalPIDFile()}, program...)
+}
+
+// sendSignal delivers the signal to the program running in the channel using a second exec in the container.
+func (c *channelHandler) sendSignal(signal string) error {
+	n := c.networkHandler
+	if !n.config.Pod.Signals.Enable {
+		return fmt.Errorf("signals are not supported")
+	}
+	if _, ok := signalNumbers[signal]; !ok {
+		return fmt.Errorf("unsupported signal: %s", signal)
+	}
+
+	n.mutex.Lock()
+	running := c.running
+	n.mutex.Unlock()
+	if !running {
+		return fmt.Errorf("program not running")
+	}
+
+	return c.signalProgram(context.Background(), signal)
+}
+
+// signalProgram sends the signal to the program running in the channel without checking whether it is still running.
+func (c *channelHandler) signalProgram(ctx context.Context, signal string) error {
+	n := c.networkHandler
+	pod := n.currentPod()
+	_, err := n.execPodCommand(ctx, pod, PodCommand{
+		Command: []string{n.config.Pod.Signals.Shell, "-c", signalKillScript, signal, c.signalPIDFile()},
+	})
+	if err != nil {
+		n.logger.Debugf("failed to deliver signal %s to channel %d (%v)", signal, c.channelID, err)
+		return fmt.Errorf("failed to deliver signal %s (%w)", signal, err)
+	}
+	return nil
+}
+
+// removeSignalPIDFile removes the PID file of the channel in the background. This is only needed in workspace pods,
+// which outlive the connection.
+func (c *channelHandler) removeSignalPIDFile() {
+	n := c.networkHandler
+	if !n.config.Pod.Signals.Enable || !n.config.Workspace.Enable || n.config.Pod.OneShot {
+		return
+	}
+	pod := n.currentPod()
+	go func() {
+		_, err := n.execPodCommand(context.Background(), pod, PodCommand{
+			Command: []string{"rm", "-f", c.signalPIDFile()},
+		})
+		if err != nil {
+			n.logger.Debugf("failed to remove PID file of channel %d (%v)", c.channelID, err)
+		}
+	}()
+}
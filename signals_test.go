@@ -0,0 +1,39 @@
+package kuberun
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignalLauncherShouldRecordPIDAndExecProgram(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.connectionID = "0123"
+	n.config.Pod.Signals.Enable = true
+	c := &channelHandler{networkHandler: n, channelID: 2}
+
+	program := c.wrapSignalLauncher([]string{"/bin/bash", "-c", "sleep 10"})
+	assert.Equal(t, []string{
+		"/bin/sh",
+		"-c",
+		signalLauncherScript,
+		"/tmp/containerssh/containerssh-0123-2.pid",
+		"/bin/bash",
+		"-c",
+		"sleep 10",
+	}, program)
+
+	n.config.Pod.Signals.Enable = false
+	assert.Equal(t, []string{"/bin/bash"}, c.wrapSignalLauncher([]string{"/bin/bash"}))
+}
+
+func TestUnknownSignalShouldBeRejected(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.Pod.Signals.Enable = true
+	c := &channelHandler{networkHandler: n, channelID: 2}
+
+	assert.Error(t, c.OnSignal(0, "WINCH"))
+	assert.Error(t, c.OnSignal(0, "INT; rm -rf /"))
+	// The program is not running, so no exec is attempted.
+	assert.Error(t, c.OnSignal(0, "INT"))
+}
@@ -0,0 +1,233 @@
+package kuberun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+)
+
+// resolveMappedUser looks up the Unix user of the SSH user in the static table and the passwd file. It returns nil if
+// the user is not mapped.
+func (n *networkHandler) resolveMappedUser() (*MappedUser, error) {
+	mapping := n.config.UserMapping
+	if user, ok := mapping.Users[n.username]; ok {
+		return &user, nil
+	}
+	if mapping.PasswdFile != "" {
+		user, err := lookupPasswdFile(mapping.PasswdFile, n.username)
+		if err != nil || user != nil {
+			return user, err
+		}
+	}
+	return nil, nil
+}
+
+// lookupPasswdFile finds the user in a file in the passwd format. It returns nil if the user is not in the file.
+func lookupPasswdFile(file string, username string) (*MappedUser, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user mapping file %s (%w)", file, err)
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 || fields[0] != username {
+			continue
+		}
+		uid, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID for user %s in %s (%w)", username, file, err)
+		}
+		gid, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GID for user %s in %s (%w)", username, file, err)
+		}
+		return &MappedUser{Name: fields[0], UID: uid, GID: gid, Home: fields[5], Shell: fields[6]}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read user mapping file %s (%w)", file, err)
+	}
+	return nil, nil
+}
+
+// mappedUserFromAnnotations reads the Unix user from the annotations of the pod, which may have been set by an
+// admission webhook or a lifecycle hook. It returns nil if the UID annotation is not set.
+func mappedUserFromAnnotations(pod *core.Pod, prefix string) (*MappedUser, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+	uidValue, ok := pod.Annotations[prefix+"uid"]
+	if !ok {
+		return nil, nil
+	}
+	uid, err := strconv.ParseInt(uidValue, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %suid annotation (%w)", prefix, err)
+	}
+	gid := uid
+	if gidValue, ok := pod.Annotations[prefix+"gid"]; ok {
+		if gid, err = strconv.ParseInt(gidValue, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid %sgid annotation (%w)", prefix, err)
+		}
+	}
+	return &MappedUser{
+		Name:  pod.Annotations[prefix+"name"],
+		UID:   uid,
+		GID:   gid,
+		Home:  pod.Annotations[prefix+"home"],
+		Shell: pod.Annotations[prefix+"shell"],
+	}, nil
+}
+
+// applyUserMappingToSpec runs all containers of the pod as the mapped user in the pod user mapping mode.
+func (n *networkHandler) applyUserMappingToSpec(spec *core.PodSpec) {
+	user := n.mappedUser
+	if n.config.UserMapping.Mode != UserMappingModePod || user == nil {
+		return
+	}
+	if spec.SecurityContext == nil {
+		spec.SecurityContext = &core.PodSecurityContext{}
+	}
+	uid := user.UID
+	gid := user.GID
+	spec.SecurityContext.RunAsUser = &uid
+	spec.SecurityContext.RunAsGroup = &gid
+	spec.SecurityContext.FSGroup = &gid
+}
+
+// runsAsMappedUser returns true if the pod itself runs as the mapped user, so it cannot be taken from the warm pool.
+func (n *networkHandler) runsAsMappedUser() bool {
+	return n.config.UserMapping.Mode == UserMappingModePod && n.mappedUser != nil
+}
+
+// mappedShell returns the shell of the mapped user, or an empty string if there is none. It must only be called after
+// the pod has started.
+func (n *networkHandler) mappedShell() string {
+	if n.mappedUser == nil {
+		return ""
+	}
+	return n.mappedUser.Shell
+}
+
+// mapUserBeforeCreate resolves the mapped user before the pod is created, so the pod mode can set it in the spec.
+func (n *networkHandler) mapUserBeforeCreate() error {
+	if n.config.UserMapping.Mode == UserMappingModeNone {
+		return nil
+	}
+	user, err := n.resolveMappedUser()
+	if err != nil {
+		return err
+	}
+	n.mappedUser = user
+	return nil
+}
+
+// mapUserAfterReady completes the user mapping once the pod is ready. In the exec mode the user may also come from
+// the pod annotations. If required, connections of unmapped users are rejected. The home directory is created if it
+// is missing.
+func (n *networkHandler) mapUserAfterReady(ctx context.Context) error {
+	mapping := n.config.UserMapping
+	if mapping.Mode == UserMappingModeNone {
+		return nil
+	}
+	pod := n.currentPod()
+	if n.mappedUser == nil && mapping.Mode == UserMappingModeExec {
+		user, err := mappedUserFromAnnotations(pod, mapping.AnnotationPrefix)
+		if err != nil {
+			return err
+		}
+		n.mappedUser = user
+	}
+	if n.mappedUser == nil {
+		if mapping.Required {
+			return fmt.Errorf("no Unix user is mapped for user %s", n.username)
+		}
+		n.logger.Debugf("no Unix user is mapped for user %s, running as the container user", n.username)
+		return nil
+	}
+	n.logger.Debugf("running sessions of user %s as UID %d GID %d", n.username, n.mappedUser.UID, n.mappedUser.GID)
+	if mapping.CreateHome && n.mappedUser.Home != "" {
+		return n.createHome(ctx, pod)
+	}
+	return nil
+}
+
+// createHome creates the home directory of the mapped user if it is missing. In the exec mode the directory is
+// created as the container user and handed over to the mapped user. In the pod mode the command already runs as the
+// mapped user, who may not be permitted to create it, so a failure is only logged.
+func (n *networkHandler) createHome(ctx context.Context, pod *core.Pod) error {
+	user := n.mappedUser
+	script := `[ -d "$0" ] || mkdir -p "$0"`
+	if n.config.UserMapping.Mode == UserMappingModeExec {
+		script = `[ -d "$0" ] || { mkdir -p "$0" && chown "$1:$2" "$0"; }`
+	}
+	result, err := n.execPodCommand(ctx, pod, PodCommand{
+		Command: []string{
+			n.config.Pod.HelperShell,
+			"-c",
+			script,
+			user.Home,
+			strconv.FormatInt(user.UID, 10),
+			strconv.FormatInt(user.GID, 10),
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	output := strings.TrimSpace(result.output)
+	if n.config.UserMapping.Mode == UserMappingModePod {
+		n.logger.Warningf("failed to create home directory %s (%v): %s", user.Home, err, output)
+		return nil
+	}
+	return fmt.Errorf("failed to create home directory %s (%w): %s", user.Home, err, output)
+}
+
+// wrapPrivilegeDrop prefixes the program with the privilege drop command in the exec user mapping mode.
+func (n *networkHandler) wrapPrivilegeDrop(program []string) []string {
+	user := n.mappedUser
+	if n.config.UserMapping.Mode != UserMappingModeExec || user == nil {
+		return program
+	}
+	return append([]string{
+		n.config.UserMapping.SetprivCommand,
+		"--reuid=" + strconv.FormatInt(user.UID, 10),
+		"--regid=" + strconv.FormatInt(user.GID, 10),
+		"--clear-groups",
+		"--",
+	}, program...)
+}
+
+// mappedUserEnv returns the variables describing the mapped user.
+func (n *networkHandler) mappedUserEnv() map[string]string {
+	user := n.mappedUser
+	if user == nil {
+		return nil
+	}
+	name := user.Name
+	if name == "" {
+		name = n.username
+	}
+	env := map[string]string{
+		"USER":    name,
+		"LOGNAME": name,
+	}
+	if user.Home != "" {
+		env["HOME"] = user.Home
+	}
+	if user.Shell != "" {
+		env["SHELL"] = user.Shell
+	}
+	return env
+}
@@ -0,0 +1,125 @@
+package kuberun
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUserMappingShouldPreferStaticTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kuberun-passwd-")
+	assert.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	passwdFile := filepath.Join(dir, "passwd")
+	assert.NoError(t, ioutil.WriteFile(passwdFile, []byte(
+		"# comment\n"+
+			"root:x:0:0:root:/root:/bin/sh\n"+
+			"foo:x:1000:1001:Foo:/home/foo:/bin/bash\n"+
+			"bar:x:1002:1002:Bar:/home/bar:/bin/zsh\n",
+	), 0600))
+
+	n := newTestNetworkHandler(t)
+	n.config.UserMapping.Mode = UserMappingModeExec
+	n.config.UserMapping.PasswdFile = passwdFile
+	n.config.UserMapping.Users = map[string]MappedUser{
+		"bar": {UID: 2000, GID: 2000, Home: "/data/bar"},
+	}
+
+	n.username = "foo"
+	user, err := n.resolveMappedUser()
+	assert.NoError(t, err)
+	assert.Equal(t, &MappedUser{Name: "foo", UID: 1000, GID: 1001, Home: "/home/foo", Shell: "/bin/bash"}, user)
+
+	n.username = "bar"
+	user, err = n.resolveMappedUser()
+	assert.NoError(t, err)
+	assert.Equal(t, &MappedUser{UID: 2000, GID: 2000, Home: "/data/bar"}, user)
+
+	n.username = "baz"
+	user, err = n.resolveMappedUser()
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func TestUserMappingShouldReadAnnotations(t *testing.T) {
+	pod := &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Annotations: map[string]string{
+				"containerssh.io/user-name": "developer",
+				"containerssh.io/user-uid":  "1000",
+				"containerssh.io/user-home": "/home/foo",
+			},
+		},
+	}
+	user, err := mappedUserFromAnnotations(pod, "containerssh.io/user-")
+	assert.NoError(t, err)
+	assert.Equal(t, &MappedUser{Name: "developer", UID: 1000, GID: 1000, Home: "/home/foo"}, user)
+
+	pod.Annotations["containerssh.io/user-gid"] = "invalid"
+	_, err = mappedUserFromAnnotations(pod, "containerssh.io/user-")
+	assert.Error(t, err)
+
+	user, err = mappedUserFromAnnotations(&core.Pod{}, "containerssh.io/user-")
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func TestUserMappingShouldApplyToPodOrExec(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "foo"
+	n.mappedUser = &MappedUser{Name: "developer", UID: 1000, GID: 1001, Home: "/home/foo", Shell: "/bin/bash"}
+	program := []string{"/bin/ls"}
+
+	n.config.UserMapping.Mode = UserMappingModePod
+	spec := &core.PodSpec{}
+	n.applyUserMappingToSpec(spec)
+	assert.Equal(t, int64(1000), *spec.SecurityContext.RunAsUser)
+	assert.Equal(t, int64(1001), *spec.SecurityContext.RunAsGroup)
+	assert.Equal(t, int64(1001), *spec.SecurityContext.FSGroup)
+	assert.Equal(t, program, n.wrapPrivilegeDrop(program))
+	assert.True(t, n.runsAsMappedUser())
+
+	n.config.UserMapping.Mode = UserMappingModeExec
+	spec = &core.PodSpec{}
+	n.applyUserMappingToSpec(spec)
+	assert.Nil(t, spec.SecurityContext)
+	assert.Equal(
+		t,
+		[]string{"setpriv", "--reuid=1000", "--regid=1001", "--clear-groups", "--", "/bin/ls"},
+		n.wrapPrivilegeDrop(program),
+	)
+	assert.False(t, n.runsAsMappedUser())
+
+	assert.Equal(t, map[string]string{
+		"USER":    "developer",
+		"LOGNAME": "developer",
+		"HOME":    "/home/foo",
+		"SHELL":   "/bin/bash",
+	}, n.mappedUserEnv())
+
+	n.mappedUser = &MappedUser{UID: 1000, GID: 1001}
+	assert.Equal(t, map[string]string{
+		"USER":    "foo",
+		"LOGNAME": "foo",
+	}, n.mappedUserEnv())
+}
+
+func TestRequiredUserMappingShouldRejectUnmappedUsers(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "foo"
+	n.pod = &core.Pod{}
+	n.config.UserMapping.Mode = UserMappingModeExec
+	n.config.UserMapping.Required = true
+	assert.Error(t, n.mapUserAfterReady(context.Background()))
+
+	n.config.UserMapping.Required = false
+	assert.NoError(t, n.mapUserAfterReady(context.Background()))
+}
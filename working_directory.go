@@ -0,0 +1,115 @@
+package kuberun
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// changeDirectoryScript changes to the directory passed as $0 and replaces itself with the program following the exit
+// status in $1, which is reported if the directory cannot be entered.
+const changeDirectoryScript = `cd "$0" || exit "$1"; shift; exec "$@"`
+
+// checkedChangeDirectoryScript changes to the directory passed as $0 and replaces itself with the program if the
+// directory lies within one of the allowed prefixes. $1 is the exit status reported if the directory cannot be
+// entered or is not allowed, and $2 the number of prefixes, followed by the prefixes and the program. The directory
+// and the prefixes are resolved with pwd -P, so symlinks cannot lead out of the prefixes.
+const checkedChangeDirectoryScript = `s="$1"; n="$2"; shift 2; cd "$0" || exit "$s"; d="$(pwd -P)/"; ok=; ` +
+	`while [ "$n" -gt 0 ]; do p="$(cd "$1" 2>/dev/null && pwd -P)"; shift; n=$((n-1)); ` +
+	`[ -n "$p" ] && case "$d" in "${p%/}"/*) ok=1;; esac; done; ` +
+	`[ -n "$ok" ] && exec "$@"; echo "the working directory $0 is not allowed" >&2; exit "$s"`
+
+// workingDirectoryTemplateData contains the fields available in the default working directory template.
+type workingDirectoryTemplateData struct {
+	Username     string
+	ConnectionID string
+	Profile      string
+	Home         string
+}
+
+// defaultWorkingDirectory renders the configured default working directory for the connection. It returns an empty
+// string if no default is configured.
+func (n *networkHandler) defaultWorkingDirectory() (string, error) {
+	if n.config.WorkingDirectory.Default == "" {
+		return "", nil
+	}
+	tpl, err := template.New("workingDirectory").Option("missingkey=error").Parse(n.config.WorkingDirectory.Default)
+	if err != nil {
+		return "", fmt.Errorf("invalid default working directory template (%w)", err)
+	}
+	data := workingDirectoryTemplateData{
+		Username:     n.username,
+		ConnectionID: n.connectionID,
+		Profile:      n.config.Profile,
+	}
+	if n.mappedUser != nil {
+		data.Home = n.mappedUser.Home
+	}
+	buf := &bytes.Buffer{}
+	if err := tpl.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("failed to render default working directory (%w)", err)
+	}
+	return buf.String(), nil
+}
+
+// checkWorkingDirectory validates a working directory requested by the client. The directory must be absolute and
+// lie within one of the allowed prefixes. It returns the cleaned directory. Symlinks can only be resolved in the
+// container, so the prefixes are checked again there when the program starts.
+func (n *networkHandler) checkWorkingDirectory(dir string) (string, error) {
+	if !path.IsAbs(dir) {
+		return "", fmt.Errorf("the working directory must be an absolute path")
+	}
+	dir = path.Clean(dir)
+	for _, prefix := range n.config.WorkingDirectory.AllowedPrefixes {
+		prefix = path.Clean(prefix)
+		if dir == prefix || strings.HasPrefix(dir, strings.TrimSuffix(prefix, "/")+"/") {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("the working directory %s is not allowed by the server", dir)
+}
+
+// isWorkingDirectoryEnv returns true if the environment variable requests a working directory.
+func (n *networkHandler) isWorkingDirectoryEnv(name string) bool {
+	return n.config.WorkingDirectory.Env != "" && name == n.config.WorkingDirectory.Env
+}
+
+// wrapWorkingDirectory prefixes the program with a change to the working directory requested by the client, or the
+// default working directory if the client didn't request one. It must be applied inside the privilege drop, so the
+// directory is entered, and access is checked, as the mapped user.
+func (c *channelHandler) wrapWorkingDirectory(program []string) ([]string, error) {
+	n := c.networkHandler
+	c.sshHandler.mutex.Lock()
+	dir := c.workingDirectory
+	c.sshHandler.mutex.Unlock()
+	exitStatus := strconv.FormatUint(uint64(n.config.ExitStatus.SetupFailure), 10)
+	if dir != "" {
+		prefixes := make([]string, 0, len(n.config.WorkingDirectory.AllowedPrefixes))
+		for _, prefix := range n.config.WorkingDirectory.AllowedPrefixes {
+			if path.IsAbs(prefix) {
+				prefixes = append(prefixes, path.Clean(prefix))
+			}
+		}
+		wrapped := []string{
+			n.config.Pod.HelperShell,
+			"-c",
+			checkedChangeDirectoryScript,
+			dir,
+			exitStatus,
+			strconv.Itoa(len(prefixes)),
+		}
+		wrapped = append(wrapped, prefixes...)
+		return append(wrapped, program...), nil
+	}
+	dir, err := n.defaultWorkingDirectory()
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return program, nil
+	}
+	return append([]string{n.config.Pod.HelperShell, "-c", changeDirectoryScript, dir, exitStatus}, program...), nil
+}
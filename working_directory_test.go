@@ -0,0 +1,59 @@
+package kuberun
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultWorkingDirectoryShouldBeTemplated(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "foo"
+	n.connectionID = "0123"
+	c := newTestChannelHandler(n)
+
+	program, err := c.wrapWorkingDirectory([]string{"/bin/ls"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/ls"}, program)
+
+	n.config.WorkingDirectory.Default = "/home/{{.Username}}/{{.ConnectionID}}"
+	n.config.Pod.HelperShell = "/bin/ash"
+	program, err = c.wrapWorkingDirectory([]string{"/bin/ls"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/bin/ash", "-c", changeDirectoryScript, "/home/foo/0123", "254", "/bin/ls"}, program)
+
+	n.mappedUser = &MappedUser{UID: 1000, GID: 1000, Home: "/data/foo"}
+	n.config.WorkingDirectory.Default = "{{.Home}}"
+	dir, err := n.defaultWorkingDirectory()
+	assert.NoError(t, err)
+	assert.Equal(t, "/data/foo", dir)
+
+	n.config.WorkingDirectory.Default = "/home/{{.Nonexistent}}"
+	_, err = c.wrapWorkingDirectory([]string{"/bin/ls"})
+	assert.Error(t, err)
+}
+
+func TestRequestedWorkingDirectoryShouldBeValidated(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.config.WorkingDirectory.Env = "LC_WORKDIR"
+	n.config.WorkingDirectory.Default = "/home"
+	c := newTestChannelHandler(n)
+
+	assert.Error(t, c.OnEnvRequest(0, "LC_WORKDIR", "/srv/project"))
+
+	n.config.WorkingDirectory.AllowedPrefixes = []string{"/srv/", "/tmp"}
+	for _, dir := range []string{"srv/project", "/srv/../etc", "/tmpfoo", "/etc"} {
+		assert.Error(t, c.OnEnvRequest(0, "LC_WORKDIR", dir), dir)
+	}
+	assert.NoError(t, c.OnEnvRequest(0, "LC_WORKDIR", "/tmp"))
+	assert.NoError(t, c.OnEnvRequest(0, "LC_WORKDIR", "/srv/project/./src/"))
+	assert.NotContains(t, c.env, "LC_WORKDIR")
+
+	program, err := c.wrapWorkingDirectory([]string{"/bin/ls"})
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{"/bin/sh", "-c", checkedChangeDirectoryScript, "/srv/project/src", "254", "2", "/srv", "/tmp", "/bin/ls"},
+		program,
+	)
+}
@@ -0,0 +1,254 @@
+package kuberun
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	workspaceLabel                = "containerssh_workspace"
+	workspaceConnectionAnnotation = "containerssh.io/connection-"
+	workspaceIdleSinceAnnotation  = "containerssh.io/idle-since"
+)
+
+var workspaceNameInvalidCharacters = regexp.MustCompile("[^a-z0-9-]+")
+
+// workspaceKey returns a label-safe key identifying the workspace of a user within the profile.
+func workspaceKey(profile string, username string) string {
+	hash := sha256.Sum256([]byte(profile + "\x00" + username))
+	return hex.EncodeToString(hash[:])[:32]
+}
+
+// workspacePodName returns the deterministic name of the workspace pod of a user.
+func workspacePodName(profile string, username string) string {
+	name := workspaceNameInvalidCharacters.ReplaceAllString(strings.ToLower(username), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 20 {
+		name = strings.Trim(name[:20], "-")
+	}
+	if name != "" {
+		name += "-"
+	}
+	return "containerssh-workspace-" + name + workspaceKey(profile, username)[:8]
+}
+
+// workspaceConnections returns the number of connections recorded on the workspace pod.
+func workspaceConnections(pod *core.Pod) int {
+	connections := 0
+	for key := range pod.Annotations {
+		if strings.HasPrefix(key, workspaceConnectionAnnotation) {
+			connections++
+		}
+	}
+	return connections
+}
+
+// workspaceAnnotations returns the initial heartbeat for a new workspace pod. Workspace pods are shared between
+// instances, so they have no owning instance.
+func (n *networkHandler) workspaceAnnotations() map[string]string {
+	annotations := n.ownerAnnotations()
+	delete(annotations, instanceAnnotation)
+	return annotations
+}
+
+// attachWorkspace finds or creates the workspace pod of the user and records the connection on it.
+func (n *networkHandler) attachWorkspace(ctx context.Context) (*core.Pod, error) {
+	for {
+		pod, err := n.findOrCreateWorkspace(ctx)
+		if err != nil {
+			return nil, err
+		}
+		updatedPod := pod.DeepCopy()
+		if updatedPod.Annotations == nil {
+			updatedPod.Annotations = map[string]string{}
+		}
+		updatedPod.Annotations[workspaceConnectionAnnotation+n.connectionID] = time.Now().UTC().Format(time.RFC3339)
+		delete(updatedPod.Annotations, workspaceIdleSinceAnnotation)
+		updatedPod, err = n.cli.CoreV1().Pods(pod.Namespace).Update(ctx, updatedPod, meta.UpdateOptions{})
+		if err == nil {
+			n.logger.Debugf("attached to workspace pod %s (%d connections)", pod.Name, workspaceConnections(updatedPod))
+			return updatedPod, nil
+		}
+		if !errors.IsConflict(err) && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		default:
+		}
+	}
+}
+
+// findOrCreateWorkspace returns the workspace pod of the user, creating it if it doesn't exist. Workspace pods that
+// have stopped running or are being deleted are replaced once they are gone, since the new pod has the same name.
+func (n *networkHandler) findOrCreateWorkspace(ctx context.Context) (*core.Pod, error) {
+	key := workspaceKey(n.config.Profile, n.username)
+	for {
+		podList, err := n.cli.CoreV1().Pods(n.config.Pod.Namespace).List(ctx, meta.ListOptions{
+			LabelSelector: labels.SelectorFromSet(map[string]string{workspaceLabel: key}).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		replaced := false
+		for i := range podList.Items {
+			pod := &podList.Items[i]
+			if pod.DeletionTimestamp == nil && pod.Status.Phase != core.PodFailed && pod.Status.Phase != core.PodSucceeded {
+				return pod, nil
+			}
+			if err := n.removeStoppedWorkspace(ctx, pod); err != nil {
+				return nil, err
+			}
+			replaced = true
+		}
+		if replaced {
+			continue
+		}
+
+		spec := createPodSpec(n.config)
+		spec.ActiveDeadlineSeconds = activeDeadlineSeconds(n.config, nil)
+		n.addConnectionEnv(spec, true)
+		n.applyUserMappingToSpec(spec)
+		podLabels := map[string]string{
+			workspaceLabel:          key,
+			"containerssh_username": n.username,
+		}
+		pod, err := n.cli.CoreV1().Pods(n.config.Pod.Namespace).Create(
+			ctx,
+			&core.Pod{
+				ObjectMeta: meta.ObjectMeta{
+					Name:            workspacePodName(n.config.Profile, n.username),
+					Namespace:       n.config.Pod.Namespace,
+					Labels:          podLabels,
+					Annotations:     n.workspaceAnnotations(),
+					OwnerReferences: n.ownerReferences,
+				},
+				Spec: *spec,
+			},
+			meta.CreateOptions{},
+		)
+		if err == nil {
+			n.logger.Debugf("created workspace pod %s", pod.Name)
+			return pod, nil
+		}
+		if !errors.IsAlreadyExists(err) {
+			return nil, err
+		}
+		// Another connection, possibly on another replica, created the pod in the meantime.
+		select {
+		case <-ctx.Done():
+			return nil, err
+		default:
+		}
+	}
+}
+
+// removeStoppedWorkspace deletes a workspace pod that has stopped running, unless it is already being deleted, and
+// waits until it is gone.
+func (n *networkHandler) removeStoppedWorkspace(ctx context.Context, pod *core.Pod) error {
+	if pod.DeletionTimestamp == nil {
+		n.logger.Infof("replacing stopped workspace pod %s (phase %s)", pod.Name, pod.Status.Phase)
+		uid := pod.UID
+		if err := n.cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{UID: &uid},
+		}); err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			return err
+		}
+	}
+	n.logger.Debugf("waiting for workspace pod %s to be removed", pod.Name)
+	if err := waitForPodDeletion(ctx, n.cli, pod); err != nil {
+		return fmt.Errorf("the previous workspace pod %s was not removed in time (%w)", pod.Name, err)
+	}
+	return nil
+}
+
+// detachWorkspace removes the connection from the workspace pod. If this was the last connection the pod is marked
+// idle and scheduled for deletion after the idle TTL.
+func (n *networkHandler) detachWorkspace(ctx context.Context, pod *core.Pod) {
+	for {
+		currentPod, err := n.cli.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, meta.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				n.logger.Warningf("failed to detach from workspace pod %s (%v)", pod.Name, err)
+			}
+			return
+		}
+		if currentPod.UID != pod.UID {
+			return
+		}
+		if currentPod.Annotations == nil {
+			currentPod.Annotations = map[string]string{}
+		}
+		delete(currentPod.Annotations, workspaceConnectionAnnotation+n.connectionID)
+		idle := workspaceConnections(currentPod) == 0
+		if idle {
+			currentPod.Annotations[workspaceIdleSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		}
+		_, err = n.cli.CoreV1().Pods(pod.Namespace).Update(ctx, currentPod, meta.UpdateOptions{})
+		if err == nil {
+			if idle {
+				n.logger.Debugf("workspace pod %s is idle, removing in %s", pod.Name, n.config.Workspace.IdleTTL)
+				n.scheduleWorkspaceRemoval(pod)
+			}
+			return
+		}
+		if !errors.IsConflict(err) {
+			n.logger.Warningf("failed to detach from workspace pod %s (%v)", pod.Name, err)
+			return
+		}
+	}
+}
+
+// scheduleWorkspaceRemoval removes the workspace pod after the idle TTL unless a connection attached in the meantime.
+// The timer only lives in this process; if it is stopped earlier, the garbage collector removes the pod based on the
+// idle annotation.
+func (n *networkHandler) scheduleWorkspaceRemoval(pod *core.Pod) {
+	time.AfterFunc(n.config.Workspace.IdleTTL, func() {
+		ctx, cancelFunc := context.WithTimeout(context.Background(), n.config.Timeout)
+		defer cancelFunc()
+		if err := removeIdleWorkspace(ctx, n.cli, pod, n.config.Workspace.IdleTTL); err != nil {
+			n.logger.Warningf("failed to remove idle workspace pod %s (%v)", pod.Name, err)
+		}
+	})
+}
+
+// removeIdleWorkspace deletes the workspace pod if it has had no connections for at least the idle TTL. The delete is
+// conditional on the resourceVersion, so a connection attaching concurrently prevents the removal.
+func removeIdleWorkspace(ctx context.Context, cli kubernetes.Interface, pod *core.Pod, idleTTL time.Duration) error {
+	currentPod, err := cli.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, meta.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if currentPod.UID != pod.UID || workspaceConnections(currentPod) > 0 {
+		return nil
+	}
+	idleSince, err := time.Parse(time.RFC3339, currentPod.Annotations[workspaceIdleSinceAnnotation])
+	if err != nil || time.Since(idleSince) < idleTTL {
+		return nil
+	}
+	err = cli.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{
+			UID:             &currentPod.UID,
+			ResourceVersion: &currentPod.ResourceVersion,
+		},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package kuberun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWorkspacePodNameShouldBeDeterministicAndValid(t *testing.T) {
+	name := workspacePodName("default", "Jane.Doe@example.com")
+	assert.Equal(t, name, workspacePodName("default", "Jane.Doe@example.com"))
+	assert.NotEqual(t, name, workspacePodName("other", "Jane.Doe@example.com"))
+	assert.Empty(t, validation.IsDNS1123Label(name))
+}
+
+func TestWorkspaceShouldBeIdleAfterLastConnectionDetaches(t *testing.T) {
+	cli := fake.NewSimpleClientset()
+	newHandler := func(connectionID string) *networkHandler {
+		n := newTestNetworkHandler(t)
+		n.cli = cli
+		n.connectionID = connectionID
+		n.username = "test"
+		n.config.Workspace.Enable = true
+		return n
+	}
+	first := newHandler("first")
+	second := newHandler("second")
+
+	pod, err := first.attachWorkspace(context.Background())
+	assert.NoError(t, err)
+	_, err = second.attachWorkspace(context.Background())
+	assert.NoError(t, err)
+
+	first.detachWorkspace(context.Background(), pod)
+	pod, err = cli.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, meta.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, workspaceConnections(pod))
+	assert.NotContains(t, pod.Annotations, workspaceIdleSinceAnnotation)
+
+	second.detachWorkspace(context.Background(), pod)
+	pod, err = cli.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, meta.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, workspaceConnections(pod))
+	assert.Contains(t, pod.Annotations, workspaceIdleSinceAnnotation)
+}
+
+func TestStoppedWorkspaceShouldBeReplaced(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "test"
+	n.connectionID = "first"
+	n.config.Workspace.Enable = true
+	n.cli = fake.NewSimpleClientset(&core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      workspacePodName(n.config.Profile, "test"),
+			Namespace: n.config.Pod.Namespace,
+			UID:       "stopped",
+			Labels:    map[string]string{workspaceLabel: workspaceKey(n.config.Profile, "test")},
+		},
+		Status: core.PodStatus{Phase: core.PodFailed},
+	})
+
+	pod, err := n.attachWorkspace(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, workspacePodName(n.config.Profile, "test"), pod.Name)
+	assert.NotEqual(t, core.PodFailed, pod.Status.Phase)
+	assert.Equal(t, 1, workspaceConnections(pod))
+}
+
+func TestDeletedWorkspaceShouldBeRecreatedOnceGone(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.username = "test"
+	n.connectionID = "first"
+	n.config.Workspace.Enable = true
+	deletionTimestamp := meta.Now()
+	name := workspacePodName(n.config.Profile, "test")
+	n.cli = fake.NewSimpleClientset(&core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:              name,
+			Namespace:         n.config.Pod.Namespace,
+			UID:               "deleting",
+			DeletionTimestamp: &deletionTimestamp,
+			Labels:            map[string]string{workspaceLabel: workspaceKey(n.config.Profile, "test")},
+		},
+	})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = n.cli.CoreV1().Pods(n.config.Pod.Namespace).Delete(context.Background(), name, meta.DeleteOptions{})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pod, err := n.attachWorkspace(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, name, pod.Name)
+	assert.Nil(t, pod.DeletionTimestamp)
+	assert.Equal(t, 1, workspaceConnections(pod))
+}
+
+func TestWorkspaceShouldRequireGC(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	config := n.config
+	config.Workspace.Enable = true
+
+	_, err := New(net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, "test", config, n.logger)
+	assert.Error(t, err)
+}
+
+func TestGCShouldRemoveIdleWorkspaceAfterTTL(t *testing.T) {
+	n := newTestNetworkHandler(t)
+	n.cli = fake.NewSimpleClientset()
+	n.username = "test"
+	n.connectionID = "first"
+	n.config.Workspace.Enable = true
+
+	pod, err := n.attachWorkspace(context.Background())
+	assert.NoError(t, err)
+	n.detachWorkspace(context.Background(), pod)
+
+	// The replica that detached stopped before its timer fired.
+	pod, err = n.cli.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, meta.GetOptions{})
+	assert.NoError(t, err)
+	pod.Annotations[workspaceIdleSinceAnnotation] = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	_, err = n.cli.CoreV1().Pods(pod.Namespace).Update(context.Background(), pod, meta.UpdateOptions{})
+	assert.NoError(t, err)
+
+	g := &garbageCollector{config: n.config, cli: n.cli, logger: n.logger}
+	assert.NoError(t, g.collect(context.Background()))
+	_, err = n.cli.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, meta.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}